@@ -0,0 +1,320 @@
+// Command admin runs maintenance operations against the cashier database.
+//
+// Usage:
+//
+//	go run admin/main.go export-sweeps [chain] > sweeps.json         export unsigned sweeps on a chain, the primary chain by default, for the offline signer
+//	go run admin/main.go broadcast-sweeps signed.json [chain]        broadcast sweeps signed by the offline signer on the chain they were exported for
+//	go run admin/main.go export-user-key <user> <out.json> <reason> [--allow-derived]
+//	                                                                 export a user's wallet as a keystore v3 file, HD derived wallets only with --allow-derived
+//	go run admin/main.go import-user-key <user> <in.json> <reason>   attach a keystore v3 file as a user's wallet
+//	go run admin/main.go key-audit                                   list wallet key exports and imports
+//	go run admin/main.go cancel-withdrawal <id>                      replace a pending withdrawal with a zero-value self-transfer
+//	go run admin/main.go deposit-balances                            list deposit addresses holding ETH on every chain
+//	go run admin/main.go verify-ledger                               check the ledger balances against user balances
+//	go run admin/main.go ledger <account>                            list ledger entries for an account, e.g. user:<id> or treasury
+//	go run admin/main.go revalue-treasury                            book FX gain or loss on the treasury at the current ETH price
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	ethcashier "github.com/gotsteez/eth_cashier"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal("usage: admin export-sweeps | broadcast-sweeps | export-user-key | import-user-key | key-audit | cancel-withdrawal | deposit-balances | verify-ledger | ledger | revalue-treasury")
+	}
+	if err := godotenv.Load("./configs/.env"); err != nil {
+		log.Fatalf("env could not be loaded correctly: %v", err)
+	}
+
+	db, err := ethcashier.InitDB("database.db")
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	ctx := context.Background()
+
+	switch os.Args[1] {
+	case "export-sweeps":
+		var chain string
+		if len(os.Args) > 2 {
+			chain = os.Args[2]
+		}
+		sweeps, err := ethcashier.ExportSweeps(ctx, db, dialChain(ctx, db, chain), adminAddress())
+		if err != nil {
+			log.Fatalf("Failed to export sweeps: %v", err)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(sweeps); err != nil {
+			log.Fatalf("Failed to write sweeps: %v", err)
+		}
+		log.Printf("exported %d sweeps", len(sweeps))
+
+	case "broadcast-sweeps":
+		if len(os.Args) < 3 {
+			log.Fatal("usage: admin broadcast-sweeps <signed.json> [chain]")
+		}
+		data, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to read signed sweeps: %v", err)
+		}
+		var signed []ethcashier.SignedSweep
+		if err := json.Unmarshal(data, &signed); err != nil {
+			log.Fatalf("Failed to parse signed sweeps: %v", err)
+		}
+		var chain string
+		if len(os.Args) > 3 {
+			chain = os.Args[3]
+		}
+		if err := ethcashier.BroadcastSweeps(ctx, db, dialChain(ctx, db, chain), signed); err != nil {
+			log.Fatalf("Failed to broadcast sweeps: %v", err)
+		}
+		log.Printf("broadcast %d sweeps", len(signed))
+
+	case "export-user-key":
+		if len(os.Args) < 5 {
+			log.Fatal("usage: admin export-user-key <user> <out.json> <reason> [--allow-derived]")
+		}
+		allowDerived := len(os.Args) > 5 && os.Args[5] == "--allow-derived"
+		passphrase, err := ethcashier.ReadPassphrase("", "Passphrase for exported keystore: ")
+		if err != nil {
+			log.Fatalf("Failed to read passphrase: %v", err)
+		}
+		keyJSON, err := ethcashier.ExportUserKeystore(db, loadHDWallet(), loadKeyring(db), os.Args[2], passphrase, operator(), os.Args[4], allowDerived)
+		if err != nil {
+			log.Fatalf("Failed to export user key: %v", err)
+		}
+		if err := os.WriteFile(os.Args[3], keyJSON, 0600); err != nil {
+			log.Fatalf("Failed to write keystore: %v", err)
+		}
+		log.Printf("exported wallet for user %s to %s", os.Args[2], os.Args[3])
+
+	case "import-user-key":
+		if len(os.Args) < 5 {
+			log.Fatal("usage: admin import-user-key <user> <in.json> <reason>")
+		}
+		keyJSON, err := os.ReadFile(os.Args[3])
+		if err != nil {
+			log.Fatalf("Failed to read keystore: %v", err)
+		}
+		passphrase, err := ethcashier.ReadPassphrase("", "Keystore passphrase: ")
+		if err != nil {
+			log.Fatalf("Failed to read passphrase: %v", err)
+		}
+		chains, err := ethcashier.ChainsFromEnv()
+		if err != nil {
+			log.Fatalf("Failed to load chains: %v", err)
+		}
+		tokens := make(map[string][]ethcashier.Token)
+		for _, chain := range chains {
+			if tokens[chain.Name], err = ethcashier.ParseTokens(chain.Tokens); err != nil {
+				log.Fatalf("Invalid tokens for %s: %v", chain.Name, err)
+			}
+		}
+		address, err := ethcashier.ImportUserKeystore(ctx, db, dialChains(ctx, db), tokens, loadKeyring(db), os.Args[2], keyJSON, passphrase, operator(), os.Args[4])
+		if err != nil {
+			log.Fatalf("Failed to import user key: %v", err)
+		}
+		log.Printf("user %s deposit address is now %s", os.Args[2], address)
+
+	case "key-audit":
+		entries, err := db.ListKeyAuditEntries()
+		if err != nil {
+			log.Fatalf("Failed to list key audit log: %v", err)
+		}
+		for _, e := range entries {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", e.CreatedAt.Format("2006-01-02 15:04:05"), e.Action, e.UserID, e.Address, e.Operator, e.Reason)
+		}
+
+	case "cancel-withdrawal":
+		if len(os.Args) < 3 {
+			log.Fatal("usage: admin cancel-withdrawal <id>")
+		}
+		id, err := strconv.ParseInt(os.Args[2], 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid withdrawal id %q", os.Args[2])
+		}
+		rpcs := dialChains(ctx, db)
+		withdrawal, err := db.GetWithdrawal(id)
+		if err != nil || withdrawal == nil {
+			log.Fatalf("Withdrawal %d not found: %v", id, err)
+		}
+		rpc := rpcs[0]
+		for _, r := range rpcs {
+			if r.Chain() == withdrawal.Chain {
+				rpc = r
+			}
+		}
+		adminSigner, err := ethcashier.AdminSignerFromEnv()
+		if err != nil {
+			log.Fatalf("Failed to load admin wallet: %v", err)
+		}
+		txHash, err := ethcashier.CancelWithdrawal(ctx, db, rpc, adminSigner, id)
+		if err != nil {
+			log.Fatalf("Failed to cancel withdrawal: %v", err)
+		}
+		log.Printf("sent cancellation %s, the withdrawal is refunded once it is mined", txHash)
+
+	case "deposit-balances":
+		users, err := db.ListUsers()
+		if err != nil {
+			log.Fatalf("Failed to list users: %v", err)
+		}
+		addresses := make([]string, len(users))
+		for i, user := range users {
+			addresses[i] = user.Wallet.PublicKey
+		}
+		for _, rpc := range dialChains(ctx, db) {
+			balances, err := rpc.GetBalances(ctx, addresses)
+			if err != nil {
+				log.Fatalf("Failed to read balances on %s: %v", rpc.Chain(), err)
+			}
+			for i, balance := range balances {
+				if balance.Sign() > 0 {
+					fmt.Printf("%s\t%s\t%s\t%s\n", rpc.Chain(), users[i].ID, users[i].Wallet.PublicKey, balance)
+				}
+			}
+		}
+
+	case "verify-ledger":
+		if err := db.VerifyLedger(); err != nil {
+			log.Fatalf("Ledger does not balance: %v", err)
+		}
+		log.Print("ledger balances")
+
+	case "ledger":
+		if len(os.Args) < 3 {
+			log.Fatal("usage: admin ledger <account>")
+		}
+		entries, err := db.ListLedgerEntries(os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to list ledger entries: %v", err)
+		}
+		var balance ethcashier.USD
+		for _, e := range entries {
+			balance += e.Amount
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", e.CreatedAt.Format("2006-01-02 15:04:05"), e.TxnID, e.Kind, e.Amount, e.Memo)
+		}
+		fmt.Printf("balance\t%s\n", balance)
+
+	case "revalue-treasury":
+		cmcAPIKey := os.Getenv("CMC_API_KEY")
+		if cmcAPIKey == "" {
+			log.Fatal("CMC API key is missing from env variables")
+		}
+		gain, err := ethcashier.RevalueTreasury(ctx, db, dialChains(ctx, db), ethcashier.NewCMCClient(cmcAPIKey), adminAddress())
+		if err != nil {
+			log.Fatalf("Failed to revalue treasury: %v", err)
+		}
+		log.Printf("booked FX gain of %s USD", gain)
+
+	default:
+		log.Fatalf("unknown command %q", os.Args[1])
+	}
+}
+
+// dialChains connects to every configured chain, primary first, the same
+// way the server does, and assigns records from before multi-chain support
+// to the primary chain
+func dialChains(ctx context.Context, db *ethcashier.DB) []*ethcashier.RPCClient {
+	chains, err := ethcashier.ChainsFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to load chains: %v", err)
+	}
+	if err := db.AdoptLegacyRows(chains[0].Name); err != nil {
+		log.Fatalf("Failed to assign existing records to chain %s: %v", chains[0].Name, err)
+	}
+	rpcs := make([]*ethcashier.RPCClient, len(chains))
+	for i, chain := range chains {
+		rpc, err := ethcashier.DialChain(ctx, chain)
+		if err != nil {
+			log.Fatalf("Failed to initialize rpc client for %s: %v", chain.Name, err)
+		}
+		rpcs[i] = rpc
+	}
+	return rpcs
+}
+
+// dialChain connects to the named chain, or to the primary chain if name is
+// empty
+func dialChain(ctx context.Context, db *ethcashier.DB, name string) *ethcashier.RPCClient {
+	rpcs := dialChains(ctx, db)
+	if name == "" {
+		return rpcs[0]
+	}
+	for _, rpc := range rpcs {
+		if rpc.Chain() == name {
+			return rpc
+		}
+	}
+	log.Fatalf("unknown chain %q", name)
+	return nil
+}
+
+func loadKeyring(db *ethcashier.DB) *ethcashier.Keyring {
+	secretPassword := os.Getenv("SECRET_PASSWORD")
+	if secretPassword == "" {
+		log.Fatal("SECRET_PASSWORD is missing from env variables")
+	}
+	keyring, err := ethcashier.LoadKeyring(db, secretPassword, os.Getenv("SECRET_PASSWORD_PREVIOUS"))
+	if err != nil {
+		log.Fatalf("Failed to load wallet keys: %v", err)
+	}
+	return keyring
+}
+
+// loadHDWallet loads the HD wallet, which can only sign when created from
+// the mnemonic rather than WALLET_XPUB
+func loadHDWallet() *ethcashier.HDWallet {
+	var hd *ethcashier.HDWallet
+	var err error
+	if mnemonic := os.Getenv("WALLET_MNEMONIC"); mnemonic != "" {
+		hd, err = ethcashier.NewHDWalletFromMnemonic(mnemonic, os.Getenv("WALLET_MNEMONIC_PASSPHRASE"))
+	} else if xpub := os.Getenv("WALLET_XPUB"); xpub != "" {
+		hd, err = ethcashier.NewHDWalletFromXPub(xpub)
+	} else {
+		log.Fatal("WALLET_MNEMONIC or WALLET_XPUB is missing from env variables")
+	}
+	if err != nil {
+		log.Fatalf("Failed to load HD wallet: %v", err)
+	}
+	return hd
+}
+
+// operator identifies who ran a command in the key audit log
+func operator() string {
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return "unknown"
+}
+
+// adminAddress returns the address of the admin wallet that receives sweeps
+func adminAddress() string {
+	if address := os.Getenv("ADMIN_WALLET_ADDRESS"); address != "" {
+		return address
+	}
+	if keystorePath := os.Getenv("ADMIN_KEYSTORE_PATH"); keystorePath != "" {
+		address, err := ethcashier.KeystoreAddress(keystorePath)
+		if err != nil {
+			log.Fatalf("Failed to read admin keystore: %v", err)
+		}
+		return address
+	}
+	adminPrivateKey := os.Getenv("ADMIN_WALLET_PRIV_KEY")
+	if adminPrivateKey == "" {
+		log.Fatal("No admin private key found in env")
+	}
+	adminWallet, err := ethcashier.ParseECDSAPrivateKeyFromHex(adminPrivateKey)
+	if err != nil {
+		log.Fatalf("Admin wallet parse error: %v", err)
+	}
+	return crypto.PubkeyToAddress(adminWallet.PublicKey).Hex()
+}
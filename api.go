@@ -1,31 +1,178 @@
 package ethcashier
 
 import (
-	"crypto/ecdsa"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"net/http"
+	"strings"
+	"sync"
 
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 )
 
+// Errors returned by Check when there is nothing to credit yet
+var (
+	ErrNoDeposit           = errors.New("wallet has no new ETH deposits")
+	ErrDepositBelowMinimum = errors.New("below the minimum deposit, holding until more arrives")
+	// ErrSweepPending means a sweep from the deposit address is not yet
+	// confirmed, so the confirmed balance still includes the swept funds
+	ErrSweepPending = errors.New("previous sweep is not confirmed yet")
+)
+
+// DefaultConfirmations is how deep a block must be before deposits in it
+// are credited
+const DefaultConfirmations = 12
+
 // API struct to hold shared resources
 type API struct {
-	db              *DB
-	cmc             *CMCClient
-	rpc             *RPCClient
-	adminPrivateKey *ecdsa.PrivateKey
+	db          *DB
+	cmc         *CMCClient
+	rpc         *RPCClient
+	adminSigner Signer
+	adminNonces *NonceManager // allocates nonces for the admin wallet
+	keyring     *Keyring      // encryption keys for non-derived user wallet private keys
+	hd          *HDWallet     // derives user deposit wallets
+
+	// minDeposit is the smallest balance swept from a deposit address
+	minDeposit *big.Int
+	// confirmations is how many blocks, counting its own, a deposit needs
+	confirmations uint64
+	// tokens are the ERC-20 tokens accepted for deposits
+	tokens []Token
+	// startBlock is the first block the deposit watcher scans, if it has
+	// never run on the chain
+	startBlock uint64
+
+	// newUserMu serializes derivation index allocation
+	newUserMu sync.Mutex
+	// checkMu serializes deposit checks so /check and the deposit watcher
+	// never credit the same balance twice
+	checkMu sync.Mutex
 }
 
 // NewAPI creates a new instance of the API
-func NewAPI(db *DB, cmc *CMCClient, rpc *RPCClient, adminPrivateKey *ecdsa.PrivateKey) *API {
+func NewAPI(db *DB, cmc *CMCClient, rpc *RPCClient, adminSigner Signer, adminNonces *NonceManager, keyring *Keyring, hd *HDWallet) *API {
 	return &API{
-		db:              db,
-		cmc:             cmc,
-		rpc:             rpc,
-		adminPrivateKey: adminPrivateKey,
+		db:            db,
+		cmc:           cmc,
+		rpc:           rpc,
+		adminSigner:   adminSigner,
+		adminNonces:   adminNonces,
+		keyring:       keyring,
+		hd:            hd,
+		minDeposit:    new(big.Int),
+		confirmations: DefaultConfirmations,
+	}
+}
+
+// SetMinDeposit sets the smallest balance in wei that Check will sweep and
+// credit. Smaller balances are held on the deposit address until more
+// arrives. Balances that do not cover the sweep fee are always held.
+func (api *API) SetMinDeposit(wei *big.Int) {
+	api.minDeposit = wei
+}
+
+// SetConfirmations sets how many blocks, counting the block it is in, a
+// deposit needs before it is credited. 1 credits deposits in the latest
+// block.
+func (api *API) SetConfirmations(n uint64) error {
+	if n == 0 {
+		return fmt.Errorf("confirmations must be at least 1")
+	}
+	api.confirmations = n
+	return nil
+}
+
+// SetStartBlock sets the block the deposit watcher starts scanning at the
+// first time it runs. Zero starts at the newest confirmed block.
+func (api *API) SetStartBlock(number uint64) {
+	api.startBlock = number
+}
+
+// SetTokens sets the ERC-20 tokens accepted for deposits and withdrawals
+func (api *API) SetTokens(tokens []Token) {
+	api.tokens = tokens
+}
+
+// token returns the accepted token with the given symbol, or nil
+func (api *API) token(symbol string) *Token {
+	for i := range api.tokens {
+		if strings.EqualFold(api.tokens[i].Symbol, symbol) {
+			return &api.tokens[i]
+		}
+	}
+	return nil
+}
+
+// tokenPrice returns the USD price of one whole token
+func (api *API) tokenPrice(ctx context.Context, token *Token) (USD, error) {
+	if token.Pegged {
+		return MicrosPerDollar, nil
 	}
+	return api.cmc.GetPrice(ctx, token.Symbol)
+}
+
+// confirmedBlock returns the header of the newest confirmed block and the
+// nonce of address at it. Funds swept from address after that block still
+// show in its balance, so it fails with ErrSweepPending until every sweep
+// recorded from address is confirmed. The recorded sweeps are compared
+// rather than the node's pending nonce, which another endpoint may answer
+// from a different mempool.
+func (api *API) confirmedBlock(ctx context.Context, address string) (*types.Header, uint64, error) {
+	blockNumber, err := api.confirmedBlockNumber(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	block, err := api.rpc.HeaderByNumber(ctx, blockNumber)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	confirmedNonce, err := api.rpc.NonceAtHash(ctx, address, block.Hash())
+	if err != nil {
+		return nil, 0, err
+	}
+	recordedNonce, err := api.db.nextSweepNonce(address, api.rpc.Chain())
+	if err != nil {
+		return nil, 0, err
+	}
+	if recordedNonce > confirmedNonce {
+		return nil, 0, ErrSweepPending
+	}
+	return block, confirmedNonce, nil
+}
+
+// nextSweepNonce returns the nonce after the last sweep recorded from address
+// on chain, whether a deposit sweep or a broadcast watch-only sweep, or zero
+// if there is none
+func (db *DB) nextSweepNonce(address, chain string) (uint64, error) {
+	var next *uint64
+	err := db.QueryRow(`
+    SELECT MAX(nonce) + 1 FROM (
+        SELECT nonce FROM deposits WHERE chain = ? AND lower(address) = lower(?) AND nonce IS NOT NULL
+        UNION ALL SELECT nonce FROM sweeps WHERE chain = ? AND lower(from_address) = lower(?) AND tx_hash != ''
+    )`, chain, address, chain, address).Scan(&next)
+	if err != nil || next == nil {
+		return 0, err
+	}
+	return *next, nil
+}
+
+// confirmedBlockNumber returns the newest block with enough confirmations
+// for its deposits to be credited
+func (api *API) confirmedBlockNumber(ctx context.Context) (uint64, error) {
+	head, err := api.rpc.BlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if head+1 < api.confirmations {
+		return 0, fmt.Errorf("chain has fewer than %d blocks", api.confirmations)
+	}
+	return head + 1 - api.confirmations, nil
 }
 
 type UserRequest struct {
@@ -38,13 +185,14 @@ type NewUserResponse struct {
 }
 
 type BalanceResponse struct {
-	Balance float64 `json:"balance"`
+	Balance USD    `json:"balance"`
+	TxHash  string `json:"txHash,omitempty"` // transaction sent by the request, if any
 }
 
 type UserResponse struct {
-	User            string  `json:"user"`
-	Balance         float64 `json:"balance"`
-	WalletPublicKey string  `json:"walletPublicKey"`
+	User            string `json:"user"`
+	Balance         USD    `json:"balance"`
+	WalletPublicKey string `json:"walletPublicKey"`
 }
 
 // HandleNewUser creates a new user and returns their ID
@@ -54,9 +202,21 @@ func (api *API) HandleNewUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create new user
-	user := NewUser()
-	err := api.db.CreateUser(user)
+	// Create new user at the next free derivation index
+	api.newUserMu.Lock()
+	defer api.newUserMu.Unlock()
+
+	index, err := api.db.NextDerivationIndex()
+	if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	user, err := NewUser(api.hd, index)
+	if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	err = api.db.CreateUser(user)
 	if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
@@ -71,86 +231,292 @@ func (api *API) HandleNewUser(w http.ResponseWriter, r *http.Request) {
 }
 
 type CheckRequest struct {
-	User string `json:"user"`
+	User  string `json:"user"`
+	Chain string `json:"chain,omitempty"` // chain to check, the primary chain by default
+	Token string `json:"token,omitempty"` // symbol of an ERC-20 token to check instead of ETH
 }
 
-func (api *API) Check(user *User) (float64, error) {
-	privateKey, err := ParseECDSAPrivateKeyFromHex(user.Wallet.EncryptedPrivateKey)
+// Check sweeps any new deposit on the user's wallet that has the configured
+// number of confirmations to the admin wallet and returns their balance and
+// the hash of the sweep transaction, which is empty in watch-only mode. A
+// swept deposit is credited once its sweep is mined, by a later check or
+// SettleDeposits. It fails with ErrSweepPending while an earlier sweep is
+// not yet mined.
+func (api *API) Check(ctx context.Context, user *User) (USD, string, error) {
+	api.checkMu.Lock()
+	defer api.checkMu.Unlock()
+
+	// 1. Credit deposits swept by earlier checks that have since been mined
+	pending, err := settleDepositSweeps(ctx, api.db, api.rpc, user.ID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse private key: %v", err)
+		return 0, "", fmt.Errorf("failed to settle deposit sweeps: %v", err)
+	}
+	if pending {
+		return 0, "", ErrSweepPending
 	}
 
-	balance, err := api.rpc.GetBalance(user.Wallet.PublicKey)
+	// 2. Read the balance at the newest confirmed block, by hash so the
+	// deposit record says exactly which block it was seen in
+	block, nonce, err := api.confirmedBlock(ctx, user.Wallet.PublicKey)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get wallet balance: %v", err)
+		return 0, "", err
+	}
+	balance, err := api.rpc.BalanceAtHash(ctx, user.Wallet.PublicKey, block.Hash())
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get wallet balance: %v", err)
 	}
 
-	// If balance is 0, return early
-	if balance.Cmp(big.NewInt(0)) == 0 {
-		return 0, fmt.Errorf("wallet has no ETH balance")
+	// Watch-only deployments hold no deposit keys, so credit without sweeping
+	if api.hd.IsWatchOnly() {
+		return api.creditWithoutSweep(ctx, user, balance, block)
+	}
+
+	// ETH sent by the admin wallet for token sweep gas is not a deposit
+	if err := settleTokenSweepGas(ctx, api.db, api.rpc, user); err != nil {
+		return 0, "", fmt.Errorf("failed to settle token sweep gas: %v", err)
 	}
+	reserved, err := api.db.reservedGasWei(user.ID, api.rpc.Chain())
+	if err != nil {
+		return 0, "", err
+	}
+	balance.Sub(balance, reserved)
 
-	// Get admin's public key from private key
-	adminPublicKey := api.adminPrivateKey.Public()
-	adminPublicKeyECDSA, ok := adminPublicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return 0, fmt.Errorf("failed to get admin public key")
+	// If balance is 0, return early
+	if balance.Sign() <= 0 {
+		return 0, "", ErrNoDeposit
 	}
-	adminAddress := crypto.PubkeyToAddress(*adminPublicKeyECDSA).Hex()
 
-	// 3. Send entire balance to admin wallet
-	// Subtract a small amount for gas (0.001 ETH)
-	gasReserve := big.NewInt(1000000000000000) // 0.001 ETH in Wei
-	transferAmount := new(big.Int).Sub(balance, gasReserve)
+	adminAddress := api.adminSigner.Address().Hex()
 
-	err = api.rpc.Send(privateKey, adminAddress, transferAmount)
+	// 3. Send entire balance to admin wallet, less the exact sweep fee
+	fees, err := api.rpc.SuggestFees(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	fees = fees.Exact()
+	gas, fee, err := api.rpc.TransferCost(ctx, user.Wallet.PublicKey, adminAddress, balance, fees)
 	if err != nil {
-		return 0, fmt.Errorf("failed to send ETH to admin wallet: %v", err)
+		return 0, "", err
+	}
+	if balance.Cmp(fee) <= 0 || balance.Cmp(api.minDeposit) < 0 {
+		return 0, "", fmt.Errorf("balance of %s wei is %w", balance, ErrDepositBelowMinimum)
 	}
+	transferAmount := new(big.Int).Sub(balance, fee)
 
-	// 4. Get current ETH price
-	ethPrice, err := api.cmc.GetEthereumPrice()
+	// 4. Get current ETH price, which the deposit is credited at
+	ethPrice, err := api.cmc.GetEthereumPrice(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get ETH price: %v", err)
+		return 0, "", fmt.Errorf("failed to get ETH price: %v", err)
 	}
 
-	// Convert Wei to ETH and calculate USD value
-	ethAmount := new(big.Float).Quo(
-		new(big.Float).SetInt(transferAmount),
-		new(big.Float).SetInt(big.NewInt(1000000000000000000)), // 10^18 (Wei to ETH)
-	)
-	var ethFloat64 float64
-	ethFloat64, _ = ethAmount.Float64()
-	usdValue := ethFloat64 * ethPrice
+	// Load the deposit wallet key only now that we are about to sign. Every
+	// sweep from the address is confirmed, so the sweep takes the confirmed
+	// nonce.
+	privateKey, err := user.PrivateKey(api.hd, api.keyring)
+	if err != nil {
+		return 0, "", err
+	}
+	sweepTx, err := api.rpc.SignTransferWithGas(ctx, NewKeySigner(privateKey), adminAddress, transferAmount, nonce, gas, fees)
+	if err != nil {
+		return 0, "", err
+	}
 
-	// 5. Credit the user's balance
-	err = api.db.AddToBalance(user.ID, usdValue)
+	// 5. Record the deposit before broadcasting its sweep, so the sweep is
+	// settled even if this request goes away
+	deposit, err := newDeposit(api.rpc.Chain(), user, transferAmount, ethPrice, block, "")
 	if err != nil {
-		return 0, fmt.Errorf("failed to credit user balance: %v", err)
+		return 0, "", err
+	}
+	if err := api.db.createPendingDeposit(deposit, sweepTx); err != nil {
+		return 0, "", fmt.Errorf("failed to record deposit: %v", err)
+	}
+	if err := api.rpc.SendSignedTransaction(ctx, sweepTx); err != nil {
+		// The sweep is rebroadcast when the deposit is settled
+		return 0, "", fmt.Errorf("deposit %d sweep not broadcast yet: %v", deposit.ID, err)
 	}
 
-	// 6. Get and return updated balance
+	// 6. Get and return the balance, which includes the deposit once its
+	// sweep is mined
 	updatedUser, err := api.db.GetUser(user.ID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get updated balance: %v", err)
+		return 0, "", fmt.Errorf("failed to get balance: %v", err)
 	}
 
-	return updatedUser.Balance, nil
+	return updatedUser.Balance, sweepTx.Hash().Hex(), nil
 }
 
-// HandleCheck checks the user's current balance
-func (api *API) HandleCheck(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// CheckToken sweeps any new deposit of the ERC-20 token with the given
+// symbol on the user's wallet that has the configured number of
+// confirmations. The whole token balance is swept to the admin wallet, after
+// the admin wallet sends the deposit address any ETH it is short for gas. It
+// returns the user's balance and the hash of the token sweep. Like Check,
+// the deposit is credited once its sweep is mined.
+func (api *API) CheckToken(ctx context.Context, user *User, symbol string) (USD, string, error) {
+	token := api.token(symbol)
+	if token == nil {
+		return 0, "", fmt.Errorf("token %s is not accepted", symbol)
+	}
+	if api.hd.IsWatchOnly() {
+		return 0, "", fmt.Errorf("token deposits cannot be swept in watch-only mode")
 	}
 
-	var req CheckRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	api.checkMu.Lock()
+	defer api.checkMu.Unlock()
+
+	pending, err := settleDepositSweeps(ctx, api.db, api.rpc, user.ID)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to settle deposit sweeps: %v", err)
+	}
+	if pending {
+		return 0, "", ErrSweepPending
+	}
+
+	// 1. Read the token balance at the newest confirmed block
+	block, nonce, err := api.confirmedBlock(ctx, user.Wallet.PublicKey)
+	if err != nil {
+		return 0, "", err
+	}
+	balance, err := api.rpc.TokenBalanceAtHash(ctx, token, user.Wallet.PublicKey, block.Hash())
+	if err != nil {
+		return 0, "", err
+	}
+	if balance.Sign() == 0 {
+		return 0, "", ErrNoDeposit
+	}
+	if token.MinDeposit != nil && balance.Cmp(token.MinDeposit) < 0 {
+		return 0, "", fmt.Errorf("balance of %s %s base units is %w", balance, token.Symbol, ErrDepositBelowMinimum)
+	}
+
+	// 2. Wait for gas already sent to the address, then send any shortfall.
+	// Only the gas reserve pays for the sweep, never ETH the user deposited.
+	if err := settleTokenSweepGas(ctx, api.db, api.rpc, user); err != nil {
+		return 0, "", fmt.Errorf("failed to settle token sweep gas: %v", err)
+	}
+	fundings, err := api.db.pendingGasFundings(user.ID, api.rpc.Chain())
+	if err != nil {
+		return 0, "", err
+	}
+	for i := range fundings {
+		if err := api.waitForGasFunding(ctx, &fundings[i]); err != nil {
+			return 0, "", err
+		}
+	}
+
+	adminAddress := api.adminSigner.Address().Hex()
+	gas, err := api.rpc.EstimateTokenTransferGas(ctx, token, user.Wallet.PublicKey, adminAddress, balance)
+	if err != nil {
+		return 0, "", err
+	}
+	fees, err := api.rpc.SuggestFees(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	// Paying exactly the fee cap leaves as little ETH behind as possible
+	fees = fees.Exact()
+	cost, err := api.rpc.TokenTransferCost(ctx, token, adminAddress, balance, gas, fees)
+	if err != nil {
+		return 0, "", err
+	}
+	reserved, err := api.db.reservedGasWei(user.ID, api.rpc.Chain())
+	if err != nil {
+		return 0, "", err
+	}
+	if shortfall := new(big.Int).Sub(cost, reserved); shortfall.Sign() > 0 {
+		funding, err := api.sendGasFunding(ctx, user, token, shortfall)
+		if err != nil {
+			return 0, "", err
+		}
+		if err := api.waitForGasFunding(ctx, funding); err != nil {
+			return 0, "", err
+		}
+		fundings = append(fundings, *funding)
+	}
+
+	// 3. Price the deposit and the gas the admin wallet paid
+	price, err := api.tokenPrice(ctx, token)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get %s price: %v", token.Symbol, err)
+	}
+	ethPrice := USD(0)
+	if len(fundings) > 0 {
+		if ethPrice, err = api.cmc.GetEthereumPrice(ctx); err != nil {
+			return 0, "", fmt.Errorf("failed to get ETH price: %v", err)
+		}
+	}
+
+	// 4. Sweep the tokens to the admin wallet, recording the deposit first
+	privateKey, err := user.PrivateKey(api.hd, api.keyring)
+	if err != nil {
+		return 0, "", err
+	}
+	sweepTx, err := api.rpc.SignTokenTransferWithNonce(ctx, NewKeySigner(privateKey), token, adminAddress, balance, nonce, gas, fees)
+	if err != nil {
+		return 0, "", err
+	}
+	deposit, err := newTokenDeposit(api.rpc.Chain(), user, token, balance, price, block, "")
+	if err != nil {
+		return 0, "", err
+	}
+	if err := api.db.createPendingTokenDeposit(deposit, sweepTx, fundings, ethPrice); err != nil {
+		return 0, "", fmt.Errorf("failed to record deposit: %v", err)
+	}
+	if err := api.rpc.SendSignedTransaction(ctx, sweepTx); err != nil {
+		// The sweep is rebroadcast when the deposit is settled
+		return 0, "", fmt.Errorf("deposit %d sweep not broadcast yet: %v", deposit.ID, err)
+	}
+
+	updatedUser, err := api.db.GetUser(user.ID)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get balance: %v", err)
+	}
+	return updatedUser.Balance, sweepTx.Hash().Hex(), nil
+}
+
+// creditWithoutSweep credits any deposit on a watch-only address that has not
+// been credited yet, leaving the funds in place for the offline signer
+func (api *API) creditWithoutSweep(ctx context.Context, user *User, balance *big.Int, block *types.Header) (USD, string, error) {
+	// Account for sweeps mined since the last check
+	if err := settleSweeps(ctx, api.db, api.rpc, user); err != nil {
+		return 0, "", fmt.Errorf("failed to settle sweeps: %v", err)
+	}
+
+	unswept, err := getUnsweptWei(api.db, user.ID, api.rpc.Chain())
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get unswept balance: %v", err)
+	}
+	deposit := new(big.Int).Sub(balance, unswept)
+	if deposit.Sign() <= 0 {
+		return 0, "", ErrNoDeposit
+	}
+
+	ethPrice, err := api.cmc.GetEthereumPrice(ctx)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get ETH price: %v", err)
+	}
+
+	// Credit the deposit and remember it is now held on the address
+	d, err := newDeposit(api.rpc.Chain(), user, deposit, ethPrice, block, "")
+	if err != nil {
+		return 0, "", err
+	}
+	if err := api.db.creditUnswept(unswept, balance, d); err != nil {
+		return 0, "", fmt.Errorf("failed to credit user balance: %v", err)
 	}
 
+	updatedUser, err := api.db.GetUser(user.ID)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get updated balance: %v", err)
+	}
+	return updatedUser.Balance, "", nil
+}
+
+// HandleCheck checks the user's current balance
+func (api *API) HandleCheck(w http.ResponseWriter, r *http.Request) {
+	NewCashier(api).HandleCheck(w, r)
+}
+
+// serveCheck answers a decoded check request for the API's chain
+func (api *API) serveCheck(ctx context.Context, w http.ResponseWriter, req CheckRequest) {
 	user, err := api.db.GetUser(req.User)
 	if err != nil {
 		http.Error(w, "Failed to get user", http.StatusInternalServerError)
@@ -161,91 +527,253 @@ func (api *API) HandleCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newBalance, err := api.Check(user)
+	var newBalance USD
+	var txHash string
+	if req.Token != "" {
+		newBalance, txHash, err = api.CheckToken(ctx, user, req.Token)
+	} else {
+		newBalance, txHash, err = api.Check(ctx, user)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error checking balance: %v", err), http.StatusInternalServerError)
 		return
 	}
 	response := BalanceResponse{
 		Balance: newBalance,
+		TxHash:  txHash,
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
 type WithdrawRequest struct {
-	User   string  `json:"user"`
-	Wallet string  `json:"wallet"` // wallet to send the money to
-	Amount float64 `json:"amount"`
+	User   string `json:"user"`
+	Wallet string `json:"wallet"` // wallet to send the money to
+	Amount USD    `json:"amount"`
+	Chain  string `json:"chain,omitempty"` // chain to pay out on, the primary chain by default
+	Asset  string `json:"asset,omitempty"` // ETH, the default, or the symbol of an ERC-20 token to pay out in
 }
 
-// Withdraw sends money back to the user
-func (api *API) Withdraw(user *User, amount float64, userAddress string) (float64, error) {
-	if err := api.db.SubtractFromBalance(user.ID, amount); err != nil {
-		return 0, fmt.Errorf("Unable to subtract from balance: %v", err)
+// Withdraw sends money back to the user in asset, ETH or the symbol of an
+// accepted token, and returns their balance and the withdrawal transaction
+// hash. The withdrawal is recorded before anything is signed so
+// TrackWithdrawals can confirm, rebroadcast or refund it if this call does
+// not see it through.
+func (api *API) Withdraw(ctx context.Context, user *User, amount USD, userAddress, asset string) (USD, string, error) {
+	if amount <= 0 {
+		return 0, "", ErrNonPositiveAmount
+	}
+	if !common.IsHexAddress(userAddress) {
+		return 0, "", fmt.Errorf("invalid recipient address format")
+	}
+	var token *Token
+	if asset != assetETH {
+		if token = api.token(asset); token == nil {
+			return 0, "", fmt.Errorf("token %s is not accepted", asset)
+		}
+		asset = token.Symbol
+	}
+
+	withdrawal, err := api.db.CreateWithdrawal(user.ID, api.rpc.Chain(), asset, userAddress, amount)
+	if err != nil {
+		return 0, "", fmt.Errorf("Unable to subtract from balance: %v", err)
 	}
 
-	ethPrice, err := api.cmc.GetEthereumPrice()
+	ethPrice, err := api.cmc.GetEthereumPrice(ctx)
 	if err != nil {
 		// If we fail here, we should add the amount back to user's balance
-		api.db.AddToBalance(user.ID, amount)
-		return 0, fmt.Errorf("failed to get ETH price: %v", err)
+		api.db.failAndRefund(withdrawal, "ETH price unavailable", nil)
+		return 0, "", fmt.Errorf("failed to get ETH price: %v", err)
 	}
 
-	// 4. Convert USD to Wei (multiply by 10^18)
-	ethAmount := amount / ethPrice
-	weiAmount := new(big.Int).Mul(
-		new(big.Int).SetInt64(int64(ethAmount*1000000)), // Convert to integer (multiplied by 10^6 for precision)
-		new(big.Int).SetInt64(1000000000000),            // Multiply by 10^12 to get to Wei (10^6 * 10^12 = 10^18)
-	)
+	// 4. Convert USD to wei, or to token units at the token's price
+	price := ethPrice
+	var units *big.Int
+	if token == nil {
+		units, err = usdToWei(amount, ethPrice)
+	} else if price, err = api.tokenPrice(ctx, token); err == nil {
+		units, err = usdToUnits(amount, token.Decimals, price)
+	}
+	if err != nil {
+		api.db.failAndRefund(withdrawal, err.Error(), nil)
+		return 0, "", err
+	}
+
+	// 5. Sign the transfer at the next admin nonce and record it before it
+	// leaves the process
+	var signedTx *types.Transaction
+	err = api.adminNonces.Reserve(func(nonce uint64) error {
+		signedTx, err = api.signWithdrawal(ctx, token, userAddress, units, nonce)
+		if err != nil {
+			return fmt.Errorf("failed to sign withdrawal: %v", err)
+		}
+		signed, err := api.db.setWithdrawalSigned(withdrawal.ID, price, units, ethPrice, signedTx, api.adminSigner.Address().Hex())
+		if err != nil {
+			return fmt.Errorf("failed to record withdrawal: %v", err)
+		}
+		if !signed {
+			return errWithdrawalExpired
+		}
+		return nil
+	})
+	if err == errWithdrawalExpired {
+		return 0, "", fmt.Errorf("withdrawal %d expired before it was signed", withdrawal.ID)
+	}
+	if err != nil {
+		api.db.failAndRefund(withdrawal, err.Error(), nil)
+		return 0, "", err
+	}
 
-	// 5. Send the ETH to the user's address
-	if err := api.rpc.Send(api.adminPrivateKey, userAddress, weiAmount); err != nil {
-		// If the transfer fails, add the amount back to user's balance
-		api.db.AddToBalance(user.ID, amount)
-		return 0, fmt.Errorf("failed to send ETH: %v", err)
+	// 6. Send the ETH or tokens to the user's address
+	if err := api.rpc.SendSignedTransaction(ctx, signedTx); err != nil {
+		// The transaction may still have reached the network, so leave it
+		// to the tracker to rebroadcast or fail it rather than refunding
+		api.db.setWithdrawalError(withdrawal.ID, err.Error())
+		return 0, "", fmt.Errorf("withdrawal %d not broadcast yet: %v", withdrawal.ID, err)
+	}
+	if err := api.db.setWithdrawalBroadcast(withdrawal.ID); err != nil {
+		return 0, "", fmt.Errorf("failed to record withdrawal broadcast: %v", err)
 	}
 
-	// 6. Get and return the updated balance
+	// 7. Get and return the updated balance
 	updatedUser, err := api.db.GetUser(user.ID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get updated balance: %v", err)
+		return 0, "", fmt.Errorf("failed to get updated balance: %v", err)
 	}
-	return updatedUser.Balance, nil
+	return updatedUser.Balance, signedTx.Hash().Hex(), nil
 }
 
-// HandleWithdraw processes a withdrawal request
-func (api *API) HandleWithdraw(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// signWithdrawal signs a payout of amount wei, or of amount of token's base
+// units, from the admin wallet at the given nonce
+func (api *API) signWithdrawal(ctx context.Context, token *Token, to string, amount *big.Int, nonce uint64) (*types.Transaction, error) {
+	if token == nil {
+		return api.rpc.SignTransferWithNonce(ctx, api.adminSigner, to, amount, nonce, nil)
 	}
 
-	var req WithdrawRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	adminAddress := api.adminSigner.Address().Hex()
+	balance, err := api.rpc.TokenBalance(ctx, token, adminAddress)
+	if err != nil {
+		return nil, err
+	}
+	if balance.Cmp(amount) < 0 {
+		return nil, fmt.Errorf("insufficient %s for transfer: need %v but got %v", token.Symbol, amount, balance)
+	}
+	gas, err := api.rpc.EstimateTokenTransferGas(ctx, token, adminAddress, to, amount)
+	if err != nil {
+		return nil, err
 	}
+	fees, err := api.rpc.SuggestFees(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.rpc.SignTokenTransferWithNonce(ctx, api.adminSigner, token, to, amount, nonce, gas, fees)
+}
 
+// HandleWithdraw processes a withdrawal request
+func (api *API) HandleWithdraw(w http.ResponseWriter, r *http.Request) {
+	NewCashier(api).HandleWithdraw(w, r)
+}
+
+// serveWithdraw answers a decoded withdrawal request for the API's chain
+func (api *API) serveWithdraw(ctx context.Context, w http.ResponseWriter, req WithdrawRequest) {
 	// Get updated user info
 	user, err := api.db.GetUser(req.User)
 	if err != nil {
 		http.Error(w, "Failed to find user", http.StatusInternalServerError)
 		return
 	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 
-	newBalance, err := api.Withdraw(user, req.Amount, req.Wallet)
+	asset := strings.ToUpper(req.Asset)
+	if asset == "" {
+		asset = assetETH
+	}
+	newBalance, txHash, err := api.Withdraw(ctx, user, req.Amount, req.Wallet, asset)
+	if errors.Is(err, ErrNonPositiveAmount) {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to withdraw balance", http.StatusInternalServerError)
 		return
 	}
 	response := BalanceResponse{
 		Balance: newBalance,
+		TxHash:  txHash,
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleDeposits lists the deposits credited to the user given by the user
+// query parameter
+func (api *API) HandleDeposits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		http.Error(w, "Missing user", http.StatusBadRequest)
+		return
+	}
+
+	user, err := api.db.GetUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	deposits, err := api.db.ListDeposits(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to list deposits", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(deposits)
+}
+
+// HandleWithdrawals lists the withdrawals of the user given by the user
+// query parameter
+func (api *API) HandleWithdrawals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	if userID == "" {
+		http.Error(w, "Missing user", http.StatusBadRequest)
+		return
+	}
+
+	user, err := api.db.GetUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	withdrawals, err := api.db.ListWithdrawals(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to list withdrawals", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(withdrawals)
+}
+
 // HandleGetUser gets information about a specific user
 func (api *API) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -280,8 +808,84 @@ func (api *API) HandleGetUser(w http.ResponseWriter, r *http.Request) {
 
 // SetupRoutes configures the HTTP routes
 func (api *API) SetupRoutes() {
-	http.HandleFunc("/newUser", api.HandleNewUser)
-	http.HandleFunc("/check", api.HandleCheck)
-	http.HandleFunc("/withdraw", api.HandleWithdraw)
-	http.HandleFunc("/user", api.HandleGetUser)
+	NewCashier(api).SetupRoutes()
+}
+
+// Cashier serves the HTTP API over one API per chain, routing deposit
+// checks and withdrawals to the chain they name. Users, balances and the
+// other routes are shared by every chain and served by the primary chain.
+type Cashier struct {
+	apis []*API // the first is the primary chain
+}
+
+// NewCashier creates a Cashier over the APIs of each chain, primary first
+func NewCashier(apis ...*API) *Cashier {
+	return &Cashier{apis: apis}
+}
+
+// api returns the API of the named chain, the primary chain's if chain is
+// empty, or nil if the chain is unknown
+func (c *Cashier) api(chain string) *API {
+	if chain == "" {
+		return c.apis[0]
+	}
+	for _, api := range c.apis {
+		if api.rpc.Chain() == chain {
+			return api
+		}
+	}
+	return nil
+}
+
+// HandleCheck checks the user's current balance on the requested chain
+func (c *Cashier) HandleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	api := c.api(req.Chain)
+	if api == nil {
+		http.Error(w, "Unknown chain", http.StatusBadRequest)
+		return
+	}
+	api.serveCheck(r.Context(), w, req)
+}
+
+// HandleWithdraw processes a withdrawal request on the requested chain
+func (c *Cashier) HandleWithdraw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req WithdrawRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	api := c.api(req.Chain)
+	if api == nil {
+		http.Error(w, "Unknown chain", http.StatusBadRequest)
+		return
+	}
+	api.serveWithdraw(r.Context(), w, req)
+}
+
+// SetupRoutes configures the HTTP routes
+func (c *Cashier) SetupRoutes() {
+	primary := c.apis[0]
+	http.HandleFunc("/newUser", primary.HandleNewUser)
+	http.HandleFunc("/check", c.HandleCheck)
+	http.HandleFunc("/withdraw", c.HandleWithdraw)
+	http.HandleFunc("/user", primary.HandleGetUser)
+	http.HandleFunc("/deposits", primary.HandleDeposits)
+	http.HandleFunc("/withdrawals", primary.HandleWithdrawals)
 }
@@ -0,0 +1,219 @@
+package ethcashier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Chain is an EVM network the cashier accepts deposits on and pays
+// withdrawals from. Users have the same deposit address on every chain, and
+// the admin wallet has the same address too.
+type Chain struct {
+	// Name tags the deposits and withdrawals made on the chain, such as
+	// "ethereum" or "arbitrum"
+	Name string `json:"name"`
+	// ID is the chain's EIP-155 chain ID, which every RPC endpoint must
+	// report at startup. It is required.
+	ID uint64 `json:"chainId"`
+	// RPCURLs are endpoints of the chain, used healthiest first
+	RPCURLs []string `json:"rpcUrls"`
+	// NativeAsset is the chain's gas token. Only ETH is supported, which
+	// covers mainnet and the major rollups.
+	NativeAsset string `json:"nativeAsset"`
+	// Confirmations is how deep a block must be before deposits in it are
+	// credited, DefaultConfirmations if zero
+	Confirmations uint64 `json:"confirmations"`
+	// StartBlock is the block the deposit watcher starts scanning at the
+	// first time it runs, the newest confirmed block if zero
+	StartBlock uint64    `json:"startBlock"`
+	Fees       FeeConfig `json:"fees"`
+	// Tokens are the ERC-20 tokens accepted on the chain, in the format read
+	// by ParseTokens
+	Tokens string `json:"tokens"`
+}
+
+var chainNamePattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// LoadChains reads the chain registry, a JSON array of chains, from path.
+// The first chain is the primary chain, which requests that do not name a
+// chain use.
+func LoadChains(path string) ([]Chain, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var chains []Chain
+	if err := decoder.Decode(&chains); err != nil {
+		return nil, fmt.Errorf("invalid chain registry: %v", err)
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("chain registry lists no chains")
+	}
+
+	seen := make(map[string]bool)
+	for i := range chains {
+		c := &chains[i]
+		if seen[c.Name] {
+			return nil, fmt.Errorf("chain %s is listed twice", c.Name)
+		}
+		seen[c.Name] = true
+		if err := c.setDefaults(); err != nil {
+			return nil, fmt.Errorf("chain %q: %v", c.Name, err)
+		}
+	}
+	return chains, nil
+}
+
+// ChainsFromEnv reads the chain registry from CHAINS_FILE, or builds a
+// single chain from the comma separated URLs in RPC_URL, CHAIN_ID,
+// ERC20_TOKENS and the fee and deposit settings in the env
+func ChainsFromEnv() ([]Chain, error) {
+	if path := os.Getenv("CHAINS_FILE"); path != "" {
+		return LoadChains(path)
+	}
+
+	rpcURL := os.Getenv("RPC_URL")
+	if rpcURL == "" {
+		return nil, fmt.Errorf("RPC URL is missing from env variables")
+	}
+	chain := Chain{
+		Name:    os.Getenv("CHAIN_NAME"),
+		RPCURLs: strings.Split(rpcURL, ","),
+		Tokens:  os.Getenv("ERC20_TOKENS"),
+	}
+	if chain.Name == "" {
+		chain.Name = "ethereum"
+	}
+	var err error
+	chain.Fees, err = ParseFeeConfig(os.Getenv("MAX_FEE_BASE_FEE_MULTIPLIER"), os.Getenv("PRIORITY_FEE_MULTIPLIER"), os.Getenv("MAX_FEE_PER_GAS_WEI"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fee config: %v", err)
+	}
+	chain.Fees.Model = os.Getenv("FEE_MODEL")
+	chainID := os.Getenv("CHAIN_ID")
+	if chainID == "" {
+		return nil, fmt.Errorf("CHAIN_ID is missing from env variables")
+	}
+	chain.ID, err = strconv.ParseUint(chainID, 10, 64)
+	if err != nil || chain.ID == 0 {
+		return nil, fmt.Errorf("invalid CHAIN_ID %q", chainID)
+	}
+	if startBlock := os.Getenv("DEPOSIT_START_BLOCK"); startBlock != "" {
+		chain.StartBlock, err = strconv.ParseUint(startBlock, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DEPOSIT_START_BLOCK %q", startBlock)
+		}
+	}
+	if confirmations := os.Getenv("DEPOSIT_CONFIRMATIONS"); confirmations != "" {
+		chain.Confirmations, err = strconv.ParseUint(confirmations, 10, 64)
+		if err != nil || chain.Confirmations == 0 {
+			return nil, fmt.Errorf("invalid DEPOSIT_CONFIRMATIONS %q", confirmations)
+		}
+	}
+	return []Chain{chain}, nil
+}
+
+// setDefaults fills in the fields left out of a chain's config and checks
+// the rest
+func (c *Chain) setDefaults() error {
+	if !chainNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("invalid chain name %q, use lowercase letters, digits and dashes", c.Name)
+	}
+	if c.ID == 0 {
+		return fmt.Errorf("no chain ID")
+	}
+	if len(c.RPCURLs) == 0 {
+		return fmt.Errorf("no RPC URLs")
+	}
+	if c.NativeAsset == "" {
+		c.NativeAsset = assetETH
+	}
+	if c.NativeAsset != assetETH {
+		return fmt.Errorf("native asset %s is not supported, only ETH", c.NativeAsset)
+	}
+	if c.Fees.BaseFeeMultiplier == 0 {
+		c.Fees.BaseFeeMultiplier = DefaultFeeConfig.BaseFeeMultiplier
+	}
+	if c.Fees.TipMultiplier == 0 {
+		c.Fees.TipMultiplier = DefaultFeeConfig.TipMultiplier
+	}
+	if err := c.Fees.validate(); err != nil {
+		return err
+	}
+	if _, err := ParseTokens(c.Tokens); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DialChain connects to the chain's RPC URLs with the chain's fee config
+// and verifies their chain ID, failing if an endpoint reports a chain ID
+// other than the chain's
+func DialChain(ctx context.Context, chain Chain) (*RPCClient, error) {
+	if err := chain.setDefaults(); err != nil {
+		return nil, fmt.Errorf("chain %q: %v", chain.Name, err)
+	}
+	rpc, err := NewRPCClient(chain.RPCURLs...)
+	if err != nil {
+		return nil, err
+	}
+	if err := rpc.VerifyChainID(ctx, chain.ID); err != nil {
+		return nil, fmt.Errorf("chain %q: %v", chain.Name, err)
+	}
+	if err := rpc.SetFeeConfig(chain.Fees); err != nil {
+		return nil, fmt.Errorf("chain %s: %v", chain.Name, err)
+	}
+	rpc.chain = chain.Name
+	return rpc, nil
+}
+
+// AdoptLegacyRows assigns the deposits, withdrawals, gas fundings, sweeps
+// and nonces recorded before multi-chain support to chain, normally the
+// primary chain. It runs once per database.
+func (db *DB) AdoptLegacyRows(chain string) error {
+	adopted, err := db.getSetting(settingLegacyChain)
+	if err != nil {
+		return err
+	}
+	if adopted != "" {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"deposits", "withdrawals", "gas_fundings", "sweeps"} {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET chain = ? WHERE chain = ''", table), chain); err != nil {
+			return fmt.Errorf("failed to adopt %s: %v", table, err)
+		}
+	}
+
+	// Move the nonces under keys naming the chain
+	_, err = tx.Exec(`
+    UPDATE settings SET key = ? || ? || ':' || substr(key, ?)
+    WHERE key LIKE ? AND key NOT LIKE ?`,
+		settingNoncePrefix, chain, len(settingNoncePrefix)+1,
+		settingNoncePrefix+"0x%", settingNoncePrefix+"%:%:%")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+    INSERT INTO settings (key, value) VALUES (?, ?)
+    ON CONFLICT(key) DO UPDATE SET value = excluded.value`, settingLegacyChain, chain)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,64 @@
+package ethcashier
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChainsFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    Chain
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"RPC_URL": "http://a", "CHAIN_ID": "1"},
+			want: Chain{Name: "ethereum", ID: 1, RPCURLs: []string{"http://a"}},
+		},
+		{
+			name: "deposit settings",
+			env: map[string]string{
+				"RPC_URL":               "http://a,http://b",
+				"CHAIN_ID":              "10",
+				"CHAIN_NAME":            "optimism",
+				"ERC20_TOKENS":          "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:peg",
+				"DEPOSIT_START_BLOCK":   "100",
+				"DEPOSIT_CONFIRMATIONS": "3",
+			},
+			want: Chain{
+				Name:          "optimism",
+				ID:            10,
+				RPCURLs:       []string{"http://a", "http://b"},
+				Tokens:        "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:peg",
+				StartBlock:    100,
+				Confirmations: 3,
+			},
+		},
+		{name: "no RPC URL", env: map[string]string{"CHAIN_ID": "1"}, wantErr: true},
+		{name: "no chain ID", env: map[string]string{"RPC_URL": "http://a"}, wantErr: true},
+		{name: "zero chain ID", env: map[string]string{"RPC_URL": "http://a", "CHAIN_ID": "0"}, wantErr: true},
+		{name: "invalid start block", env: map[string]string{"RPC_URL": "http://a", "CHAIN_ID": "1", "DEPOSIT_START_BLOCK": "-1"}, wantErr: true},
+		{name: "zero confirmations", env: map[string]string{"RPC_URL": "http://a", "CHAIN_ID": "1", "DEPOSIT_CONFIRMATIONS": "0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		for _, key := range []string{"CHAINS_FILE", "RPC_URL", "CHAIN_ID", "CHAIN_NAME", "ERC20_TOKENS", "DEPOSIT_START_BLOCK", "DEPOSIT_CONFIRMATIONS"} {
+			t.Setenv(key, tt.env[key])
+		}
+
+		chains, err := ChainsFromEnv()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ChainsFromEnv error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// Fee settings are covered by ParseFeeConfig
+		chains[0].Fees = FeeConfig{}
+		if !reflect.DeepEqual(chains, []Chain{tt.want}) {
+			t.Errorf("%s: ChainsFromEnv = %+v, want %+v", tt.name, chains, tt.want)
+		}
+	}
+}
@@ -1,16 +1,22 @@
 package ethcashier
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 const CMC_API_URL = "https://pro-api.coinmarketcap.com/v1/cryptocurrency/quotes/latest"
 
+// DefaultPriceTimeout is how long a price request may take
+const DefaultPriceTimeout = 10 * time.Second
+
 type CMCClient struct {
 	apiKey string
+	client *http.Client
 }
 
 // Response structures for CoinMarketCap API
@@ -23,32 +29,45 @@ type CryptoCurrency struct {
 }
 
 type PriceQuote struct {
-	Price float64 `json:"price"`
+	// Price is kept as the raw JSON number so it can be parsed exactly
+	Price json.Number `json:"price"`
 }
 
 func NewCMCClient(apiKey string) *CMCClient {
 	return &CMCClient{
 		apiKey: apiKey,
+		client: &http.Client{Timeout: DefaultPriceTimeout},
 	}
 }
 
-// GetEthereumPrice returns the current price of Ethereum in USD
-func (c *CMCClient) GetEthereumPrice() (float64, error) {
-	req, err := http.NewRequest("GET", CMC_API_URL, nil)
+// SetTimeout sets how long a price request may take
+func (c *CMCClient) SetTimeout(timeout time.Duration) {
+	c.client.Timeout = timeout
+}
+
+// GetEthereumPrice returns the current price of Ethereum in USD, truncated
+// to the micro-dollar
+func (c *CMCClient) GetEthereumPrice(ctx context.Context) (USD, error) {
+	return c.GetPrice(ctx, "ETH")
+}
+
+// GetPrice returns the current price in USD of the cryptocurrency with the
+// given symbol, truncated to the micro-dollar
+func (c *CMCClient) GetPrice(ctx context.Context, symbol string) (USD, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", CMC_API_URL, nil)
 	if err != nil {
 		return 0, fmt.Errorf("error creating request: %v", err)
 	}
 
 	q := req.URL.Query()
-	q.Add("symbol", "ETH")
+	q.Add("symbol", symbol)
 	q.Add("convert", "USD")
 	req.URL.RawQuery = q.Encode()
 
 	req.Header.Add("X-CMC_PRO_API_KEY", c.apiKey)
 	req.Header.Add("Accept", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return 0, fmt.Errorf("error making request: %v", err)
 	}
@@ -68,15 +87,22 @@ func (c *CMCClient) GetEthereumPrice() (float64, error) {
 		return 0, fmt.Errorf("error parsing response: %v", err)
 	}
 
-	ethData, exists := response.Data["ETH"]
+	data, exists := response.Data[symbol]
 	if !exists {
-		return 0, fmt.Errorf("ethereum data not found in response")
+		return 0, fmt.Errorf("%s data not found in response", symbol)
 	}
 
-	usdQuote, exists := ethData.Quote["USD"]
+	usdQuote, exists := data.Quote["USD"]
 	if !exists {
 		return 0, fmt.Errorf("USD quote not found in response")
 	}
 
-	return usdQuote.Price, nil
+	price, _, err := parseMicros(usdQuote.Price.String())
+	if err != nil {
+		return 0, fmt.Errorf("error parsing price: %v", err)
+	}
+	if price <= 0 {
+		return 0, fmt.Errorf("invalid %s price %s", symbol, usdQuote.Price)
+	}
+	return price, nil
 }
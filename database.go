@@ -1,8 +1,13 @@
 package ethcashier
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"strconv"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -15,6 +20,7 @@ type DB struct {
 var (
 	ErrInsufficientFunds = errors.New("insufficient funds for withdrawal")
 	ErrNegativeAmount    = errors.New("amount cannot be negative")
+	ErrNonPositiveAmount = errors.New("amount must be positive")
 )
 
 func InitDB(dbPath string) (*DB, error) {
@@ -37,30 +43,522 @@ func createTables(db *sql.DB) error {
         id TEXT PRIMARY KEY,
         encrypted_private_key TEXT,
         public_key TEXT,
-        balance REAL
+        balance_micros INTEGER NOT NULL DEFAULT 0,
+        derivation_index INTEGER
     );`
 
-	_, err := db.Exec(userTable)
+	settingsTable := `
+    CREATE TABLE IF NOT EXISTS settings (
+        key TEXT PRIMARY KEY,
+        value TEXT
+    );`
+
+	sweepsTable := `
+    CREATE TABLE IF NOT EXISTS sweeps (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT,
+        chain TEXT NOT NULL DEFAULT '',
+        from_address TEXT,
+        to_address TEXT,
+        nonce INTEGER,
+        amount_wei TEXT,
+        gas_price_wei TEXT,
+        gas_tip_cap_wei TEXT NOT NULL DEFAULT '',
+        tx_hash TEXT NOT NULL DEFAULT '',
+        settled INTEGER NOT NULL DEFAULT 0,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+
+	keyAuditTable := `
+    CREATE TABLE IF NOT EXISTS key_audit_log (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT,
+        action TEXT,
+        address TEXT,
+        operator TEXT,
+        reason TEXT,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+
+	// amount_micros is positive for a debit and negative for a credit
+	ledgerTable := `
+    CREATE TABLE IF NOT EXISTS ledger_entries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        txn_id TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        account TEXT NOT NULL,
+        amount_micros INTEGER NOT NULL,
+        memo TEXT NOT NULL DEFAULT '',
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+
+	depositsTable := `
+    CREATE TABLE IF NOT EXISTS deposits (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT NOT NULL,
+        address TEXT NOT NULL,
+        chain TEXT NOT NULL DEFAULT '',
+        asset TEXT NOT NULL DEFAULT 'ETH',
+        tx_hash TEXT NOT NULL DEFAULT '',
+        block_number INTEGER NOT NULL,
+        block_hash TEXT NOT NULL DEFAULT '',
+        amount_wei TEXT NOT NULL,
+        price_micros INTEGER NOT NULL,
+        amount_micros INTEGER NOT NULL,
+        ledger_txn_id TEXT NOT NULL,
+        nonce INTEGER,
+        raw_tx TEXT NOT NULL DEFAULT '',
+        status TEXT NOT NULL DEFAULT 'credited',
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+
+	withdrawalsTable := `
+    CREATE TABLE IF NOT EXISTS withdrawals (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT NOT NULL,
+        to_address TEXT NOT NULL,
+        chain TEXT NOT NULL DEFAULT '',
+        asset TEXT NOT NULL DEFAULT 'ETH',
+        amount_micros INTEGER NOT NULL,
+        price_micros INTEGER NOT NULL DEFAULT 0,
+        amount_wei TEXT NOT NULL DEFAULT '',
+        fee_eth_price_micros INTEGER NOT NULL DEFAULT 0,
+        status TEXT NOT NULL,
+        from_address TEXT NOT NULL DEFAULT '',
+        nonce INTEGER,
+        tx_hash TEXT NOT NULL DEFAULT '',
+        raw_tx TEXT NOT NULL DEFAULT '',
+        error TEXT NOT NULL DEFAULT '',
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+
+	// every transaction sent at a withdrawal's nonce, including replacements
+	withdrawalTxsTable := `
+    CREATE TABLE IF NOT EXISTS withdrawal_txs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        withdrawal_id INTEGER NOT NULL,
+        kind TEXT NOT NULL,
+        tx_hash TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+
+	// ETH sent from the admin wallet to deposit addresses to pay for token sweeps
+	gasFundingsTable := `
+    CREATE TABLE IF NOT EXISTS gas_fundings (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id TEXT NOT NULL,
+        chain TEXT NOT NULL DEFAULT '',
+        asset TEXT NOT NULL,
+        from_address TEXT NOT NULL,
+        nonce INTEGER NOT NULL,
+        amount_wei TEXT NOT NULL,
+        tx_hash TEXT NOT NULL,
+        raw_tx TEXT NOT NULL,
+        status TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+
+	// ETH on each deposit address that the admin wallet sent for token sweep
+	// gas, and the last token sweep whose gas has not been taken out of it
+	gasReservesTable := `
+    CREATE TABLE IF NOT EXISTS gas_reserves (
+        user_id TEXT NOT NULL,
+        chain TEXT NOT NULL,
+        reserve_wei TEXT NOT NULL DEFAULT '0',
+        sweep_tx TEXT NOT NULL DEFAULT '',
+        PRIMARY KEY (user_id, chain)
+    );`
+
+	// Credited wei still held on each watch-only deposit address, per chain
+	unsweptTable := `
+    CREATE TABLE IF NOT EXISTS unswept_balances (
+        user_id TEXT NOT NULL,
+        chain TEXT NOT NULL,
+        unswept_wei TEXT NOT NULL DEFAULT '0',
+        PRIMARY KEY (user_id, chain)
+    );`
+
+	// Deposit checks the watcher failed to run, retried on every scan
+	depositRetriesTable := `
+    CREATE TABLE IF NOT EXISTS deposit_retries (
+        user_id TEXT NOT NULL,
+        chain TEXT NOT NULL,
+        asset TEXT NOT NULL,
+        error TEXT NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 1,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, chain, asset)
+    );`
+
+	tables := []string{
+		userTable, settingsTable, sweepsTable, keyAuditTable,
+		ledgerTable, depositsTable, withdrawalsTable, withdrawalTxsTable,
+		gasFundingsTable, gasReservesTable, unsweptTable, depositRetriesTable,
+	}
+	for _, table := range tables {
+		if _, err := db.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	// Columns added after the initial schema
+	if err := addColumnIfMissing(db, "users", "derivation_index", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "balance_micros", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "sweeps", "gas_tip_cap_wei", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Token deposits and withdrawals store the token's price, not ETH's
+	if err := renameColumnIfPresent(db, "deposits", "eth_price_micros", "price_micros"); err != nil {
+		return err
+	}
+	if err := renameColumnIfPresent(db, "withdrawals", "eth_price_micros", "price_micros"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "deposits", "block_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "deposits", "status", "TEXT NOT NULL DEFAULT 'credited'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "deposits", "asset", "TEXT NOT NULL DEFAULT 'ETH'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "deposits", "nonce", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "deposits", "raw_tx", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "withdrawals", "asset", "TEXT NOT NULL DEFAULT 'ETH'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "withdrawals", "fee_eth_price_micros", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	for _, table := range []string{"deposits", "withdrawals", "gas_fundings", "sweeps"} {
+		if err := addColumnIfMissing(db, table, "chain", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+
+	if err := migrateBalancesToMicros(db); err != nil {
+		return err
+	}
+	if err := openLedger(db); err != nil {
+		return err
+	}
+
+	indexes := []string{
+		"CREATE UNIQUE INDEX IF NOT EXISTS users_derivation_index ON users (derivation_index)",
+		"CREATE INDEX IF NOT EXISTS ledger_entries_account ON ledger_entries (account)",
+		"CREATE INDEX IF NOT EXISTS ledger_entries_txn_id ON ledger_entries (txn_id)",
+		"CREATE INDEX IF NOT EXISTS deposits_user_id ON deposits (user_id)",
+		"CREATE INDEX IF NOT EXISTS deposits_chain_block_number ON deposits (chain, block_number)",
+		"CREATE INDEX IF NOT EXISTS deposits_status ON deposits (status)",
+		"CREATE INDEX IF NOT EXISTS withdrawals_user_id ON withdrawals (user_id)",
+		"CREATE INDEX IF NOT EXISTS withdrawals_status ON withdrawals (status)",
+		"CREATE INDEX IF NOT EXISTS withdrawal_txs_withdrawal_id ON withdrawal_txs (withdrawal_id)",
+		"CREATE INDEX IF NOT EXISTS gas_fundings_user_id ON gas_fundings (user_id)",
+	}
+	for _, index := range indexes {
+		if _, err := db.Exec(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateBalancesToMicros converts the floating point balance column used
+// by older databases into exact integer micro-dollars
+func migrateBalancesToMicros(db *sql.DB) error {
+	legacy, err := hasColumn(db, "users", "balance")
+	if err != nil || !legacy {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, balance FROM users")
+	if err != nil {
+		return err
+	}
+	balances := make(map[string]USD)
+	for rows.Next() {
+		var id string
+		var balance sql.NullFloat64
+		if err := rows.Scan(&id, &balance); err != nil {
+			rows.Close()
+			return err
+		}
+		balances[id] = usdFromFloat(balance.Float64)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, balance := range balances {
+		_, err := tx.Exec("UPDATE users SET balance_micros = ? WHERE id = ?", balance, id)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("ALTER TABLE users DROP COLUMN balance"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing adds a column to an existing table created by an older
+// version of the schema
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// renameColumnIfPresent renames a column of a table created by an older
+// version of the schema
+func renameColumnIfPresent(db *sql.DB, table, column, newName string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, column, newName))
+	return err
+}
+
+// hasColumn reports whether table has the given column
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Keys used in the settings table
+const (
+	settingKeySalt       = "key_salt"
+	settingKeysEncrypted = "wallet_keys_encrypted"
+	// first derivation index above any index retired by a wallet import
+	settingRetiredIndexes = "retired_derivation_indexes"
+	// set once existing balances have been posted to the ledger
+	settingLedgerOpened = "ledger_opened"
+	// followed by a chain name, a colon and a lowercase address, the next
+	// nonce to send from the address on the chain
+	settingNoncePrefix = "next_nonce:"
+	// followed by a chain name, the last block scanned for deposits on the
+	// chain by the deposit watcher
+	settingDepositCursor = "deposit_scan_block:"
+	// the chain that rows recorded before multi-chain support belong to
+	settingLegacyChain = "legacy_chain"
+	keySaltLen         = 16
+)
+
+// getSetting returns the value stored for key, or "" if it has not been set
+func (db *DB) getSetting(key string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+func (db *DB) setSetting(key, value string) error {
+	_, err := db.Exec(`
+    INSERT INTO settings (key, value) VALUES (?, ?)
+    ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, value)
 	return err
 }
 
+// getKeySalt returns the key derivation salt stored under setting,
+// generating and storing one the first time it is requested
+func (db *DB) getKeySalt(setting string) ([]byte, error) {
+	stored, err := db.getSetting(setting)
+	if err != nil {
+		return nil, err
+	}
+	if stored != "" {
+		return hex.DecodeString(stored)
+	}
+
+	salt := make([]byte, keySaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	if err := db.setSetting(setting, hex.EncodeToString(salt)); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// EncryptPlaintextKeys is a one-shot migration that encrypts every wallet key
+// that was stored in plaintext before encryption was enabled. It returns the
+// number of rows migrated.
+func (db *DB) EncryptPlaintextKeys(keyring *Keyring) (int, error) {
+	done, err := db.getSetting(settingKeysEncrypted)
+	if err != nil {
+		return 0, err
+	}
+	if done != "" {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, encrypted_private_key FROM users")
+	if err != nil {
+		return 0, err
+	}
+	plaintext := make(map[string]string)
+	for rows.Next() {
+		var id, storedKey string
+		if err := rows.Scan(&id, &storedKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if isPlaintextPrivateKey(storedKey) {
+			plaintext[id] = storedKey
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, privateKeyHex := range plaintext {
+		encryptedKey, err := keyring.Encrypt(privateKeyHex)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt key for user %s: %v", id, err)
+		}
+		_, err = tx.Exec("UPDATE users SET encrypted_private_key = ? WHERE id = ?", encryptedKey, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO settings (key, value) VALUES (?, ?)", settingKeysEncrypted, "1")
+	if err != nil {
+		return 0, err
+	}
+	return len(plaintext), tx.Commit()
+}
+
 func (db *DB) CreateUser(user *User) error {
 	query := `
-    INSERT INTO users (id, encrypted_private_key, public_key, balance)
-    VALUES (?, ?, ?, ?)`
+    INSERT INTO users (id, encrypted_private_key, public_key, balance_micros, derivation_index)
+    VALUES (?, ?, ?, ?, ?)`
 
 	_, err := db.Exec(query,
 		user.ID,
 		user.Wallet.EncryptedPrivateKey,
 		user.Wallet.PublicKey,
-		user.Balance)
+		user.Balance,
+		user.Wallet.DerivationIndex)
 	return err
 }
 
+// NextDerivationIndex returns the first HD derivation index not yet assigned
+// to a user
+func (db *DB) NextDerivationIndex() (uint32, error) {
+	var next uint32
+	err := db.QueryRow("SELECT COALESCE(MAX(derivation_index) + 1, 0) FROM users").Scan(&next)
+	if err != nil {
+		return 0, err
+	}
+
+	// Indexes retired by replacing a user's wallet are never handed out again
+	retired, err := db.getSetting(settingRetiredIndexes)
+	if err != nil {
+		return 0, err
+	}
+	if retired != "" {
+		floor, err := strconv.ParseUint(retired, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid retired index setting %q: %v", retired, err)
+		}
+		if uint32(floor) > next {
+			next = uint32(floor)
+		}
+	}
+	return next, nil
+}
+
+// VerifyDerivedAddresses checks that every HD derived user address matches
+// the address the given wallet derives at the same index, catching a wrong
+// mnemonic before any deposits are credited to addresses we cannot sign for
+func (db *DB) VerifyDerivedAddresses(hd *HDWallet) error {
+	rows, err := db.Query(`
+    SELECT id, public_key, derivation_index
+    FROM users WHERE derivation_index IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, publicKey string
+		var index uint32
+		if err := rows.Scan(&id, &publicKey, &index); err != nil {
+			return err
+		}
+		address, err := hd.Address(index)
+		if err != nil {
+			return err
+		}
+		if address != publicKey {
+			return fmt.Errorf("user %s address %s does not match derived address %s at index %d", id, publicKey, address, index)
+		}
+	}
+	return rows.Err()
+}
+
 func (db *DB) GetUser(id string) (*User, error) {
 	user := &User{}
 	query := `
-    SELECT id, encrypted_private_key, public_key, balance
+    SELECT id, encrypted_private_key, public_key, balance_micros, derivation_index
     FROM users WHERE id = ?`
 
 	row := db.QueryRow(query, id)
@@ -68,7 +566,8 @@ func (db *DB) GetUser(id string) (*User, error) {
 		&user.ID,
 		&user.Wallet.EncryptedPrivateKey,
 		&user.Wallet.PublicKey,
-		&user.Balance)
+		&user.Balance,
+		&user.Wallet.DerivationIndex)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -79,67 +578,97 @@ func (db *DB) GetUser(id string) (*User, error) {
 	return user, nil
 }
 
-// AddToBalance adds the specified amount to user's balance
-func (db *DB) AddToBalance(id string, amount float64) error {
-	if amount < 0 {
-		return ErrNegativeAmount
+// RotateWalletKeys re-encrypts every wallet key that is not sealed under the
+// keyring's current version, committing batchSize rows at a time so the
+// server can keep running while it works. It returns the number of rows
+// re-encrypted.
+func (db *DB) RotateWalletKeys(keyring *Keyring, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("batch size must be positive")
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+	rotated := 0
+	lastID := ""
+	for {
+		n, nextID, err := db.rotateWalletKeyBatch(keyring, lastID, batchSize)
+		if err != nil {
+			return rotated, err
+		}
+		rotated += n
+		if nextID == "" {
+			return rotated, nil
+		}
+		lastID = nextID
 	}
-	defer tx.Rollback()
+}
 
-	// Get current balance
-	var currentBalance float64
-	err = tx.QueryRow("SELECT balance FROM users WHERE id = ?", id).Scan(&currentBalance)
+// rotateWalletKeyBatch re-encrypts up to batchSize users with ids after
+// lastID and returns the last id it looked at, or "" once all rows are done
+func (db *DB) rotateWalletKeyBatch(keyring *Keyring, lastID string, batchSize int) (int, string, error) {
+	rows, err := db.Query(`
+    SELECT id, encrypted_private_key
+    FROM users WHERE id > ? AND encrypted_private_key != ''
+    ORDER BY id LIMIT ?`, lastID, batchSize)
 	if err != nil {
-		return err
+		return 0, "", err
 	}
+	stale := make(map[string]string)
+	nextID := ""
+	count := 0
+	for rows.Next() {
+		var id, encryptedKey string
+		if err := rows.Scan(&id, &encryptedKey); err != nil {
+			rows.Close()
+			return 0, "", err
+		}
+		nextID = id
+		count++
 
-	// Update balance
-	newBalance := currentBalance + amount
-	_, err = tx.Exec("UPDATE users SET balance = ? WHERE id = ?", newBalance, id)
-	if err != nil {
-		return err
+		rotate, err := keyring.needsRotation(encryptedKey)
+		if err != nil {
+			rows.Close()
+			return 0, "", fmt.Errorf("failed to read key for user %s: %v", id, err)
+		}
+		if rotate {
+			stale[id] = encryptedKey
+		}
 	}
-
-	return tx.Commit()
-}
-
-// SubtractFromBalance subtracts the specified amount from user's balance
-func (db *DB) SubtractFromBalance(id string, amount float64) error {
-	if amount < 0 {
-		return ErrNegativeAmount
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+	if count < batchSize {
+		nextID = ""
 	}
 
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return 0, "", err
 	}
 	defer tx.Rollback()
 
-	// Get current balance
-	var currentBalance float64
-	err = tx.QueryRow("SELECT balance FROM users WHERE id = ?", id).Scan(&currentBalance)
-	if err != nil {
-		return err
-	}
-
-	// Check if there are sufficient funds
-	if currentBalance < amount {
-		return ErrInsufficientFunds
-	}
-
-	// Update balance
-	newBalance := currentBalance - amount
-	_, err = tx.Exec("UPDATE users SET balance = ? WHERE id = ?", newBalance, id)
-	if err != nil {
-		return err
+	rotated := 0
+	for id, encryptedKey := range stale {
+		privateKeyHex, err := keyring.Decrypt(encryptedKey)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to decrypt key for user %s: %v", id, err)
+		}
+		reencrypted, err := keyring.Encrypt(privateKeyHex)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to encrypt key for user %s: %v", id, err)
+		}
+		// Only replace the row if it has not changed since we read it
+		result, err := tx.Exec(`
+        UPDATE users SET encrypted_private_key = ?
+        WHERE id = ? AND encrypted_private_key = ?`, reencrypted, id, encryptedKey)
+		if err != nil {
+			return 0, "", err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			rotated++
+		}
 	}
-
-	return tx.Commit()
+	return rotated, nextID, tx.Commit()
 }
 
 func (db *DB) DeleteUser(id string) error {
@@ -150,7 +679,7 @@ func (db *DB) DeleteUser(id string) error {
 
 func (db *DB) ListUsers() ([]User, error) {
 	query := `
-    SELECT id, encrypted_private_key, public_key, balance
+    SELECT id, encrypted_private_key, public_key, balance_micros, derivation_index
     FROM users`
 
 	rows, err := db.Query(query)
@@ -166,7 +695,8 @@ func (db *DB) ListUsers() ([]User, error) {
 			&user.ID,
 			&user.Wallet.EncryptedPrivateKey,
 			&user.Wallet.PublicKey,
-			&user.Balance)
+			&user.Balance,
+			&user.Wallet.DerivationIndex)
 		if err != nil {
 			return nil, err
 		}
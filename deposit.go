@@ -0,0 +1,346 @@
+package ethcashier
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Deposit statuses. A swept deposit is pending until its sweep is mined,
+// then credited, or failed if the sweep reverted, or dropped if its nonce
+// was used by another transaction. Watch-only deposits are credited at once.
+const (
+	DepositPending  = "pending"
+	DepositCredited = "credited"
+	DepositFailed   = "failed"
+	DepositDropped  = "dropped"
+	// DepositReversed is a deposit taken back because its block was orphaned
+	DepositReversed = "reversed"
+)
+
+// Deposit records how a credit to a user's balance was computed
+type Deposit struct {
+	ID          int64     `json:"id"`
+	User        string    `json:"user"`
+	Address     string    `json:"address"`     // deposit address the funds arrived at
+	Chain       string    `json:"chain"`       // chain the funds arrived on
+	Asset       string    `json:"asset"`       // ETH or the symbol of an ERC-20 token
+	TxHash      string    `json:"txHash"`      // sweep to the admin wallet, empty for watch-only deposits
+	BlockNumber uint64    `json:"blockNumber"` // block the deposit address balance was read at
+	BlockHash   string    `json:"blockHash"`   // hash of that block, to detect it being reorged out
+	AmountWei   string    `json:"amountWei"`   // wei, or token base units, credited
+	Price       USD       `json:"price"`       // USD per ETH, or per token, applied
+	Amount      USD       `json:"amount"`      // USD credited
+	LedgerTxnID string    `json:"ledgerTxnId"` // ledger transaction posting the credit, empty until credited
+	Nonce       *uint64   `json:"nonce"`       // nonce of the sweep
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	rawTx string
+}
+
+// newDeposit computes the USD value of amountWei at ethPrice, seen at block
+// on chain
+func newDeposit(chain string, user *User, amountWei *big.Int, ethPrice USD, block *types.Header, txHash string) (*Deposit, error) {
+	amount, err := weiToUSD(amountWei, ethPrice)
+	if err != nil {
+		return nil, err
+	}
+	return &Deposit{
+		User:        user.ID,
+		Address:     user.Wallet.PublicKey,
+		Chain:       chain,
+		Asset:       assetETH,
+		TxHash:      txHash,
+		BlockNumber: block.Number.Uint64(),
+		BlockHash:   block.Hash().Hex(),
+		AmountWei:   amountWei.String(),
+		Price:       ethPrice,
+		Amount:      amount,
+		Status:      DepositCredited,
+	}, nil
+}
+
+// newTokenDeposit computes the USD value of amount base units of token at
+// price per whole token, seen at block on chain
+func newTokenDeposit(chain string, user *User, token *Token, amount *big.Int, price USD, block *types.Header, txHash string) (*Deposit, error) {
+	usd, err := unitsToUSD(amount, token.Decimals, price)
+	if err != nil {
+		return nil, err
+	}
+	return &Deposit{
+		User:        user.ID,
+		Address:     user.Wallet.PublicKey,
+		Chain:       chain,
+		Asset:       token.Symbol,
+		TxHash:      txHash,
+		BlockNumber: block.Number.Uint64(),
+		BlockHash:   block.Hash().Hex(),
+		AmountWei:   amount.String(),
+		Price:       price,
+		Amount:      usd,
+		Status:      DepositCredited,
+	}, nil
+}
+
+// treasuryAccount returns the ledger account the deposited asset is held in
+func (d *Deposit) treasuryAccount() string {
+	return assetTreasury(d.Asset)
+}
+
+// createPendingDeposit records a deposit whose sweep is signedTx without
+// crediting it, filling in its ID. It must be recorded before the sweep is
+// broadcast so the sweep is always settled.
+func (db *DB) createPendingDeposit(d *Deposit, signedTx *types.Transaction) error {
+	if err := d.setSweep(signedTx); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertDepositTx(tx, d); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createPendingTokenDeposit records a token deposit whose sweep is signedTx
+// without crediting it, and books the gas fundings that paid for the sweep,
+// valuing them at ethPrice. The sweep's gas is settled against the
+// address's gas reserve once it is mined.
+func (db *DB) createPendingTokenDeposit(d *Deposit, signedTx *types.Transaction, fundings []gasFunding, ethPrice USD) error {
+	if err := d.setSweep(signedTx); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := useGasFundingsTx(tx, d.User, d.Chain, d.TxHash, fundings, ethPrice); err != nil {
+		return err
+	}
+	if err := insertDepositTx(tx, d); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setSweep makes signedTx the pending sweep of the deposit
+func (d *Deposit) setSweep(signedTx *types.Transaction) error {
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	nonce := signedTx.Nonce()
+	d.TxHash = signedTx.Hash().Hex()
+	d.Nonce = &nonce
+	d.rawTx = hex.EncodeToString(raw)
+	d.Status = DepositPending
+	return nil
+}
+
+func createDepositTx(tx *sql.Tx, d *Deposit) error {
+	if err := postDepositTx(tx, d); err != nil {
+		return err
+	}
+	return insertDepositTx(tx, d)
+}
+
+// postDepositTx credits the deposit to the user's ledger account
+func postDepositTx(tx *sql.Tx, d *Deposit) error {
+	if d.Amount < 0 {
+		return ErrNegativeAmount
+	}
+
+	memo := fmt.Sprintf("%s wei at %s USD/ETH", d.AmountWei, d.Price)
+	if d.Asset != assetETH {
+		memo = fmt.Sprintf("%s %s base units at %s USD/%s", d.AmountWei, d.Asset, d.Price, d.Asset)
+	}
+	memo += " on " + d.Chain
+	if d.TxHash != "" {
+		memo += ", swept in " + d.TxHash
+	}
+	txnID, err := postTx(tx, LedgerDeposit, memo, depositPostings(d.treasuryAccount(), d.User, d.Amount))
+	if err != nil {
+		return err
+	}
+	d.LedgerTxnID = txnID
+	return nil
+}
+
+func insertDepositTx(tx *sql.Tx, d *Deposit) error {
+	result, err := tx.Exec(`
+    INSERT INTO deposits (user_id, address, chain, asset, tx_hash, block_number, block_hash, amount_wei, price_micros, amount_micros, ledger_txn_id, nonce, raw_tx, status)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.User, d.Address, d.Chain, d.Asset, d.TxHash, d.BlockNumber, d.BlockHash, d.AmountWei, d.Price, d.Amount, d.LedgerTxnID, d.Nonce, d.rawTx, d.Status)
+	if err != nil {
+		return err
+	}
+	d.ID, err = result.LastInsertId()
+	return err
+}
+
+// creditDeposit credits a pending deposit whose sweep was mined successfully
+// and anchors it to the sweep's block, so CheckDepositReorgs reverses it if
+// the sweep is reorged out
+func (db *DB) creditDeposit(d *Deposit, receipt *types.Receipt) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := postDepositTx(tx, d); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+    UPDATE deposits SET status = ?, ledger_txn_id = ?, block_number = ?, block_hash = ?
+    WHERE id = ? AND status = ?`,
+		DepositCredited, d.LedgerTxnID, receipt.BlockNumber.Uint64(), receipt.BlockHash.Hex(), d.ID, DepositPending)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		// Already settled
+		return err
+	}
+	return tx.Commit()
+}
+
+// failDeposit settles a pending deposit as failed or dropped without
+// crediting it, leaving the funds on the deposit address for the next check
+func (db *DB) failDeposit(d *Deposit, status string) error {
+	_, err := db.Exec("UPDATE deposits SET status = ? WHERE id = ? AND status = ?", status, d.ID, DepositPending)
+	return err
+}
+
+// SettleDeposits settles every pending deposit on the client's chain,
+// crediting those whose sweep has been mined
+func SettleDeposits(ctx context.Context, db *DB, rpc *RPCClient) error {
+	_, err := settleDepositSweeps(ctx, db, rpc, "")
+	return err
+}
+
+// settleDepositSweeps settles the user's pending deposits on the client's
+// chain, or every pending deposit on the chain if userID is empty. It
+// reports whether any sweep is still pending.
+func settleDepositSweeps(ctx context.Context, db *DB, rpc *RPCClient, userID string) (bool, error) {
+	query := depositColumns + " WHERE chain = ? AND status = ?"
+	args := []any{rpc.Chain(), DepositPending}
+	if userID != "" {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	deposits, err := db.queryDeposits(query+" ORDER BY id", args...)
+	if err != nil {
+		return false, err
+	}
+
+	pending := false
+	var errs []error
+	for i := range deposits {
+		settled, err := settleDepositSweep(ctx, db, rpc, &deposits[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deposit %d: %v", deposits[i].ID, err))
+		}
+		if !settled {
+			pending = true
+		}
+	}
+	return pending, errors.Join(errs...)
+}
+
+// settleDepositSweep credits a pending deposit once its sweep is mined
+// successfully, and fails it if the sweep reverted or its nonce was used by
+// another transaction. A sweep that is still pending is rebroadcast in case
+// it was dropped from the mempool. It reports whether the deposit was
+// settled.
+func settleDepositSweep(ctx context.Context, db *DB, rpc *RPCClient, d *Deposit) (bool, error) {
+	receipt, err := rpc.TransactionReceipt(ctx, d.TxHash)
+	if err != nil {
+		return false, err
+	}
+	if receipt == nil {
+		// The nonce being used without the sweep being mined means it was
+		// taken by another transaction. Check the receipt again, on the
+		// endpoint reporting the nonce, in case the sweep was mined in
+		// between.
+		nonce, receipts, err := rpc.NonceAndReceipts(ctx, d.Address, []string{d.TxHash})
+		if err != nil {
+			return false, err
+		}
+		if nonce <= *d.Nonce {
+			return false, rebroadcastDepositSweep(ctx, rpc, d)
+		}
+		if receipt = receipts[0]; receipt == nil {
+			return true, db.failDeposit(d, DepositDropped)
+		}
+	}
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return true, db.failDeposit(d, DepositFailed)
+	}
+	return true, db.creditDeposit(d, receipt)
+}
+
+// rebroadcastDepositSweep resends a pending deposit's sweep
+func rebroadcastDepositSweep(ctx context.Context, rpc *RPCClient, d *Deposit) error {
+	raw, err := hex.DecodeString(d.rawTx)
+	if err != nil {
+		return fmt.Errorf("invalid raw transaction: %v", err)
+	}
+	signedTx := new(types.Transaction)
+	if err := signedTx.UnmarshalBinary(raw); err != nil {
+		return fmt.Errorf("failed to decode transaction: %v", err)
+	}
+
+	err = rpc.SendSignedTransaction(ctx, signedTx)
+	if err != nil && !strings.Contains(err.Error(), "already known") {
+		return fmt.Errorf("failed to rebroadcast sweep %s: %v", d.TxHash, err)
+	}
+	return nil
+}
+
+// ListDeposits returns the user's deposits, newest first
+func (db *DB) ListDeposits(userID string) ([]Deposit, error) {
+	return db.queryDeposits(depositColumns+" WHERE user_id = ? ORDER BY id DESC", userID)
+}
+
+const depositColumns = `
+    SELECT id, user_id, address, chain, asset, tx_hash, block_number, block_hash, amount_wei,
+        price_micros, amount_micros, ledger_txn_id, nonce, raw_tx, status, created_at
+    FROM deposits`
+
+func (db *DB) queryDeposits(query string, args ...any) ([]Deposit, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deposits := []Deposit{}
+	for rows.Next() {
+		var d Deposit
+		err := rows.Scan(&d.ID, &d.User, &d.Address, &d.Chain, &d.Asset, &d.TxHash, &d.BlockNumber, &d.BlockHash,
+			&d.AmountWei, &d.Price, &d.Amount, &d.LedgerTxnID, &d.Nonce, &d.rawTx, &d.Status, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		deposits = append(deposits, d)
+	}
+	return deposits, rows.Err()
+}
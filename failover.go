@@ -0,0 +1,530 @@
+package ethcashier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	gethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+// A client with several RPC URLs sends each call to the healthiest endpoint
+// and fails over to the next one when the endpoint itself fails, such as on
+// a network error, an HTTP error or rate limiting. Errors the node returns
+// for the call itself, such as a reverted call, are returned as is.
+// Endpoints are ranked by how far their head lags the best endpoint, their
+// recent error rate and their latency, and an endpoint reporting a different
+// chain ID than the client expects is never used.
+
+const (
+	// maxHeadLag is how many blocks an endpoint can fall behind the best
+	// endpoint before it is ranked below every endpoint that keeps up
+	maxHeadLag = 3
+	// maxErrorRate is the recent error rate above which an endpoint is
+	// ranked below every endpoint with fewer errors
+	maxErrorRate = 0.5
+	// healthWeight is the weight of the latest call in the moving averages
+	// of latency and error rate
+	healthWeight = 0.2
+	// errorPenalty is the latency an endpoint is ranked as having per unit
+	// of error rate
+	errorPenalty = 10 * time.Second
+	// rateLimitedCode is the JSON-RPC error code providers use when a
+	// client exceeds its request limit
+	rateLimitedCode = -32005
+)
+
+// endpoint is one RPC URL of a client and its health
+type endpoint struct {
+	url    string
+	client *ethclient.Client
+
+	mu        sync.Mutex
+	chainID   *big.Int      // reported by the endpoint, nil until checked
+	head      uint64        // latest block at the last health check
+	latency   time.Duration // moving average of call latency
+	errorRate float64       // moving average of failed calls, from 0 to 1
+}
+
+// record updates the endpoint's health with the outcome of a call
+func (e *endpoint) record(latency time.Duration, failed bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sample := 0.0
+	if failed {
+		sample = 1
+	} else if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency += time.Duration(healthWeight * float64(latency-e.latency))
+	}
+	e.errorRate += healthWeight * (sample - e.errorRate)
+}
+
+// name identifies the endpoint in errors and logs without the path or
+// query, where providers put API keys
+func (e *endpoint) name() string {
+	u, err := url.Parse(e.url)
+	if err != nil || u.Host == "" {
+		return "endpoint"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// describe names the endpoint in err without leaking its full URL, which
+// HTTP errors include
+func (e *endpoint) describe(err error) error {
+	return fmt.Errorf("%s: %s", e.name(), strings.ReplaceAll(err.Error(), e.url, e.name()))
+}
+
+// endpointPool spreads a client's calls over its endpoints. Its methods
+// mirror those of ethclient.Client.
+type endpointPool struct {
+	endpoints []*endpoint
+	// timeout is how long one call to one endpoint may take before the
+	// call fails over
+	timeout time.Duration
+
+	mu sync.Mutex
+	// chainID is the chain ID every endpoint must report: the configured
+	// one, or else the first one an endpoint reports
+	chainID *big.Int
+}
+
+// dialEndpoints connects to each URL. Dialing an HTTP URL does not contact
+// the node, so a URL that is down is only found out by its first call.
+func dialEndpoints(rpcURLs []string) (*endpointPool, error) {
+	if len(rpcURLs) == 0 {
+		return nil, fmt.Errorf("no RPC URLs")
+	}
+	pool := &endpointPool{timeout: DefaultRPCTimeout}
+	for _, rpcURL := range rpcURLs {
+		client, err := ethclient.Dial(rpcURL)
+		if err != nil {
+			return nil, err
+		}
+		pool.endpoints = append(pool.endpoints, &endpoint{url: rpcURL, client: client})
+	}
+	return pool, nil
+}
+
+// expectedChainID returns the chain ID every endpoint must report, or nil
+// if none is configured and no endpoint has reported one yet
+func (p *endpointPool) expectedChainID() *big.Int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.chainID
+}
+
+// expectChainID pins the chain ID every endpoint must report
+func (p *endpointPool) expectChainID(id *big.Int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.chainID = id
+}
+
+// ranked returns the endpoints reporting the expected chain ID, or not
+// checked yet, healthiest first. call checks an endpoint's chain ID before
+// its first use.
+func (p *endpointPool) ranked() []*endpoint {
+	expected := p.expectedChainID()
+
+	type candidate struct {
+		e         *endpoint
+		head      uint64
+		latency   time.Duration
+		errorRate float64
+	}
+	var candidates []candidate
+	var best uint64
+	for _, e := range p.endpoints {
+		e.mu.Lock()
+		c := candidate{e: e, head: e.head, latency: e.latency, errorRate: e.errorRate}
+		mismatch := expected != nil && e.chainID != nil && e.chainID.Cmp(expected) != 0
+		e.mu.Unlock()
+		if mismatch {
+			continue
+		}
+		if c.head > best {
+			best = c.head
+		}
+		candidates = append(candidates, c)
+	}
+
+	// Endpoints that keep up with few errors come first, then by latency
+	// with recent errors counted as extra latency. Stable sorting keeps the
+	// configured order among equals.
+	healthy := func(c candidate) bool {
+		return best-c.head <= maxHeadLag && c.errorRate <= maxErrorRate
+	}
+	score := func(c candidate) time.Duration {
+		return c.latency + time.Duration(c.errorRate*float64(errorPenalty))
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if healthy(a) != healthy(b) {
+			return healthy(a)
+		}
+		return score(a) < score(b)
+	})
+
+	ranked := make([]*endpoint, len(candidates))
+	for i, c := range candidates {
+		ranked[i] = c.e
+	}
+	return ranked
+}
+
+// isEndpointError reports whether err means the endpoint failed rather than
+// the call, so the call should be retried on another endpoint
+func isEndpointError(err error) bool {
+	if err == nil || errors.Is(err, ethereum.NotFound) {
+		return false
+	}
+	var rpcErr gethrpc.Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr.ErrorCode() == rateLimitedCode
+	}
+	return true
+}
+
+// call runs fn on the healthiest endpoint, failing over to the next while
+// the endpoint fails or takes longer than the pool's timeout. It stops when
+// ctx ends.
+func call[T any](ctx context.Context, p *endpointPool, fn func(context.Context, *ethclient.Client) (T, error)) (T, error) {
+	var zero T
+	var lastErr error
+	for _, e := range p.ranked() {
+		start := time.Now()
+		callCtx, cancel := p.withTimeout(ctx)
+		err := p.checkChainID(callCtx, e)
+		var result T
+		if err == nil {
+			result, err = fn(callCtx, e.client)
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return zero, err
+		}
+		if errors.Is(err, errWrongChain) {
+			lastErr = e.describe(err)
+			continue
+		}
+		failed := isEndpointError(err)
+		e.record(time.Since(start), failed)
+		if !failed {
+			return result, err
+		}
+		lastErr = e.describe(err)
+	}
+	if lastErr == nil {
+		return zero, fmt.Errorf("no RPC endpoint on the expected chain")
+	}
+	return zero, lastErr
+}
+
+// withTimeout returns ctx limited to the pool's per call timeout
+func (p *endpointPool) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.timeout)
+}
+
+// CheckHealth refreshes the head, chain ID and latency of every endpoint.
+// If no chain ID is configured, the first endpoint to report one, in
+// configured order, sets the chain ID every endpoint must report. It
+// returns an error describing the endpoints that failed or report another
+// chain ID, and the client keeps using the others.
+func (c *RPCClient) CheckHealth(ctx context.Context) error {
+	return c.client.checkHealth(ctx)
+}
+
+func (p *endpointPool) checkHealth(ctx context.Context) error {
+	var problems []string
+	for _, e := range p.endpoints {
+		callCtx, cancel := p.withTimeout(ctx)
+		start := time.Now()
+		head, err := e.client.BlockNumber(callCtx)
+		latency := time.Since(start)
+		var chainID *big.Int
+		if err == nil {
+			chainID, err = e.client.ChainID(callCtx)
+		}
+		cancel()
+		e.record(latency, err != nil)
+		if err != nil {
+			problems = append(problems, e.describe(err).Error())
+			continue
+		}
+
+		p.mu.Lock()
+		if p.chainID == nil {
+			p.chainID = chainID
+		}
+		expected := p.chainID
+		p.mu.Unlock()
+
+		e.mu.Lock()
+		e.head = head
+		e.chainID = chainID
+		e.mu.Unlock()
+		if chainID.Cmp(expected) != 0 {
+			problems = append(problems, fmt.Sprintf("%s: chain ID %s, expected %s", e.name(), chainID, expected))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("unhealthy RPC endpoints: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// verifyChainID asks every endpoint for its chain ID and returns want. It
+// fails if an endpoint reports another chain ID, or if no endpoint answers.
+// From then on the pool expects want.
+func (p *endpointPool) verifyChainID(ctx context.Context, want *big.Int) (*big.Int, error) {
+	answered := false
+	var problems []string
+	for _, e := range p.endpoints {
+		callCtx, cancel := p.withTimeout(ctx)
+		start := time.Now()
+		chainID, err := e.client.ChainID(callCtx)
+		cancel()
+		e.record(time.Since(start), err != nil)
+		if err != nil {
+			problems = append(problems, e.describe(err).Error())
+			continue
+		}
+		answered = true
+
+		e.mu.Lock()
+		e.chainID = chainID
+		e.mu.Unlock()
+		if chainID.Cmp(want) != 0 {
+			return nil, fmt.Errorf("%s reports chain ID %s, expected %s", e.name(), chainID, want)
+		}
+	}
+	if !answered {
+		return nil, fmt.Errorf("no RPC endpoint answered: %s", strings.Join(problems, "; "))
+	}
+
+	p.expectChainID(want)
+	return want, nil
+}
+
+func (p *endpointPool) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (*big.Int, error) {
+		return c.BalanceAt(ctx, account, blockNumber)
+	})
+}
+
+func (p *endpointPool) BalanceAtHash(ctx context.Context, account common.Address, blockHash common.Hash) (*big.Int, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (*big.Int, error) {
+		return c.BalanceAtHash(ctx, account, blockHash)
+	})
+}
+
+// BatchBalanceAt reads the balances of accounts at blockNumber, or the
+// latest block if nil, in a single JSON-RPC batch request
+func (p *endpointPool) BatchBalanceAt(ctx context.Context, accounts []common.Address, blockNumber *big.Int) ([]*big.Int, error) {
+	block := "latest"
+	if blockNumber != nil {
+		block = hexutil.EncodeBig(blockNumber)
+	}
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) ([]*big.Int, error) {
+		results := make([]hexutil.Big, len(accounts))
+		batch := make([]gethrpc.BatchElem, len(accounts))
+		for i, account := range accounts {
+			batch[i] = gethrpc.BatchElem{
+				Method: "eth_getBalance",
+				Args:   []interface{}{account, block},
+				Result: &results[i],
+			}
+		}
+		if err := c.Client().BatchCallContext(ctx, batch); err != nil {
+			return nil, err
+		}
+		balances := make([]*big.Int, len(accounts))
+		for i, elem := range batch {
+			// A rate limited batch fails element by element
+			if elem.Error != nil {
+				return nil, elem.Error
+			}
+			balances[i] = results[i].ToInt()
+		}
+		return balances, nil
+	})
+}
+
+func (p *endpointPool) BlockNumber(ctx context.Context) (uint64, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (uint64, error) { return c.BlockNumber(ctx) })
+}
+
+func (p *endpointPool) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (*types.Block, error) {
+		return c.BlockByNumber(ctx, number)
+	})
+}
+
+func (p *endpointPool) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (*types.Header, error) {
+		return c.HeaderByNumber(ctx, number)
+	})
+}
+
+func (p *endpointPool) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (uint64, error) {
+		return c.NonceAt(ctx, account, blockNumber)
+	})
+}
+
+func (p *endpointPool) NonceAtHash(ctx context.Context, account common.Address, blockHash common.Hash) (uint64, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (uint64, error) {
+		return c.NonceAtHash(ctx, account, blockHash)
+	})
+}
+
+func (p *endpointPool) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (uint64, error) { return c.PendingNonceAt(ctx, account) })
+}
+
+func (p *endpointPool) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (*big.Int, error) { return c.SuggestGasTipCap(ctx) })
+}
+
+func (p *endpointPool) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (*big.Int, error) { return c.SuggestGasPrice(ctx) })
+}
+
+func (p *endpointPool) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (uint64, error) { return c.EstimateGas(ctx, msg) })
+}
+
+func (p *endpointPool) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) ([]byte, error) {
+		return c.CallContract(ctx, msg, blockNumber)
+	})
+}
+
+func (p *endpointPool) CallContractAtHash(ctx context.Context, msg ethereum.CallMsg, blockHash common.Hash) ([]byte, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) ([]byte, error) {
+		return c.CallContractAtHash(ctx, msg, blockHash)
+	})
+}
+
+func (p *endpointPool) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) ([]types.Log, error) { return c.FilterLogs(ctx, q) })
+}
+
+func (p *endpointPool) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return call(ctx, p, func(ctx context.Context, c *ethclient.Client) (*types.Receipt, error) {
+		return c.TransactionReceipt(ctx, txHash)
+	})
+}
+
+// nonceReceipts is an account's nonce and receipts read from one endpoint
+type nonceReceipts struct {
+	nonce    uint64
+	receipts []*types.Receipt
+}
+
+// NonceAndReceipts returns account's nonce at the latest block and the
+// receipts of txHashes, nil for those not mined and for zero hashes. All are
+// read from one endpoint, the receipts after the nonce, so any transaction
+// the nonce counts has its receipt.
+func (p *endpointPool) NonceAndReceipts(ctx context.Context, account common.Address, txHashes []common.Hash) (uint64, []*types.Receipt, error) {
+	result, err := call(ctx, p, func(ctx context.Context, c *ethclient.Client) (nonceReceipts, error) {
+		nonce, err := c.NonceAt(ctx, account, nil)
+		if err != nil {
+			return nonceReceipts{}, err
+		}
+		receipts := make([]*types.Receipt, len(txHashes))
+		for i, txHash := range txHashes {
+			if txHash == (common.Hash{}) {
+				continue
+			}
+			receipt, err := c.TransactionReceipt(ctx, txHash)
+			if errors.Is(err, ethereum.NotFound) {
+				continue
+			}
+			if err != nil {
+				return nonceReceipts{}, err
+			}
+			receipts[i] = receipt
+		}
+		return nonceReceipts{nonce: nonce, receipts: receipts}, nil
+	})
+	return result.nonce, result.receipts, err
+}
+
+// SendTransaction broadcasts tx on the healthiest endpoint, failing over
+// like any other call. tx must be signed for the expected chain ID.
+func (p *endpointPool) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	expected := p.expectedChainID()
+	if expected == nil {
+		// Learn the chain ID before anything is broadcast
+		p.checkHealth(ctx)
+		if expected = p.expectedChainID(); expected == nil {
+			return fmt.Errorf("no RPC endpoint reported a chain ID")
+		}
+	}
+	if tx.Protected() && tx.ChainId().Cmp(expected) != 0 {
+		return fmt.Errorf("transaction is signed for chain %s, not %s", tx.ChainId(), expected)
+	}
+
+	retried := false
+	_, err := call(ctx, p, func(ctx context.Context, c *ethclient.Client) (struct{}, error) {
+		err := c.SendTransaction(ctx, tx)
+		// An earlier endpoint may have passed tx on before it failed
+		if retried && err != nil && strings.Contains(err.Error(), "already known") {
+			err = nil
+		}
+		retried = true
+		return struct{}{}, err
+	})
+	return err
+}
+
+// errWrongChain is returned for an endpoint reporting another chain ID
+// than the pool expects
+var errWrongChain = errors.New("endpoint is on another chain")
+
+// checkChainID fails with errWrongChain unless e reports the expected chain
+// ID, asking e if it has not been checked yet. If the pool expects no chain
+// ID yet it expects the one e reports from then on.
+func (p *endpointPool) checkChainID(ctx context.Context, e *endpoint) error {
+	e.mu.Lock()
+	chainID := e.chainID
+	e.mu.Unlock()
+	if chainID == nil {
+		var err error
+		if chainID, err = e.client.ChainID(ctx); err != nil {
+			return err
+		}
+		e.mu.Lock()
+		e.chainID = chainID
+		e.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	if p.chainID == nil {
+		p.chainID = chainID
+	}
+	expected := p.chainID
+	p.mu.Unlock()
+	if chainID.Cmp(expected) != 0 {
+		return fmt.Errorf("%w: chain ID %s, expected %s", errWrongChain, chainID, expected)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package ethcashier
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestRanked(t *testing.T) {
+	type health struct {
+		head      uint64
+		latency   time.Duration
+		errorRate float64
+		chainID   int64
+	}
+	tests := []struct {
+		name      string
+		endpoints []health
+		want      []int
+	}{
+		{name: "configured order among equals", endpoints: []health{{chainID: 1}, {chainID: 1}}, want: []int{0, 1}},
+		{
+			name:      "fastest first",
+			endpoints: []health{{head: 10, latency: 50 * time.Millisecond, chainID: 1}, {head: 10, latency: 10 * time.Millisecond, chainID: 1}},
+			want:      []int{1, 0},
+		},
+		{
+			name:      "lagging head last",
+			endpoints: []health{{head: 10 - maxHeadLag - 1, latency: time.Millisecond, chainID: 1}, {head: 10, latency: time.Second, chainID: 1}},
+			want:      []int{1, 0},
+		},
+		{
+			name:      "small lag tolerated",
+			endpoints: []health{{head: 10 - maxHeadLag, latency: time.Millisecond, chainID: 1}, {head: 10, latency: time.Second, chainID: 1}},
+			want:      []int{0, 1},
+		},
+		{
+			name:      "failing endpoint last",
+			endpoints: []health{{errorRate: maxErrorRate + 0.1, chainID: 1}, {latency: time.Second, chainID: 1}},
+			want:      []int{1, 0},
+		},
+		{
+			name:      "errors count as latency",
+			endpoints: []health{{errorRate: 0.1, chainID: 1}, {latency: 500 * time.Millisecond, chainID: 1}},
+			want:      []int{1, 0},
+		},
+		{
+			name:      "other chain never used",
+			endpoints: []health{{latency: time.Millisecond, chainID: 5}, {latency: time.Second, chainID: 1}},
+			want:      []int{1},
+		},
+		{
+			name:      "unchecked endpoint",
+			endpoints: []health{{latency: time.Millisecond}, {latency: time.Second, chainID: 1}},
+			want:      []int{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		pool := &endpointPool{chainID: big.NewInt(1)}
+		for _, h := range tt.endpoints {
+			e := &endpoint{head: h.head, latency: h.latency, errorRate: h.errorRate}
+			if h.chainID != 0 {
+				e.chainID = big.NewInt(h.chainID)
+			}
+			pool.endpoints = append(pool.endpoints, e)
+		}
+
+		ranked := pool.ranked()
+		got := make([]int, len(ranked))
+		for i, e := range ranked {
+			for j, candidate := range pool.endpoints {
+				if e == candidate {
+					got[i] = j
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ranked %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail sets up how each endpoint fails, they serve 2 and 4 blocks
+		fail      func(first, second *fakeNode)
+		want      uint64
+		wantErr   string
+		wantCalls int // calls reaching the second endpoint, its chain ID check included
+	}{
+		{name: "healthy", fail: func(first, second *fakeNode) {}, want: 1},
+		{name: "endpoint down", fail: func(first, second *fakeNode) { first.down = true }, want: 3, wantCalls: 2},
+		{name: "rate limited", fail: func(first, second *fakeNode) { first.rateLimited = true }, want: 3, wantCalls: 2},
+		{name: "endpoint on another chain", fail: func(first, second *fakeNode) { first.chainID = 5 }, want: 3, wantCalls: 2},
+		{
+			name:    "every endpoint on another chain",
+			fail:    func(first, second *fakeNode) { first.chainID, second.chainID = 5, 5 },
+			wantErr: "another chain",
+			// The chain ID check is the only call
+			wantCalls: 1,
+		},
+		{
+			name:      "every endpoint down",
+			fail:      func(first, second *fakeNode) { first.down, second.down = true, true },
+			wantErr:   "503",
+			wantCalls: 0,
+		},
+	}
+	for _, tt := range tests {
+		first, second := newFakeNode(), newFakeNode()
+		first.mine()
+		second.mine()
+		second.mine()
+		second.mine()
+		tt.fail(first, second)
+		rpc := newTestRPC(t, first, second)
+
+		got, err := rpc.BlockNumber(context.Background())
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: BlockNumber error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+		} else if err != nil || got != tt.want {
+			t.Errorf("%s: BlockNumber = %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+		if second.calls != tt.wantCalls {
+			t.Errorf("%s: second endpoint answered %d calls, want %d", tt.name, second.calls, tt.wantCalls)
+		}
+	}
+}
+
+func TestCallErrorsDoNotFailOver(t *testing.T) {
+	first, second := newFakeNode(), newFakeNode()
+	rpc := newTestRPC(t, first, second)
+
+	// The fake nodes know no gas price, which is an answer and not an
+	// endpoint failure
+	if _, err := rpc.SuggestGasPrice(context.Background()); err == nil || !strings.Contains(err.Error(), "method not found") {
+		t.Fatalf("SuggestGasPrice error = %v, want method not found", err)
+	}
+	if second.calls != 0 {
+		t.Errorf("second endpoint answered %d calls, want 0", second.calls)
+	}
+}
+
+func TestNonceAndReceipts(t *testing.T) {
+	first, second := newFakeNode(), newFakeNode()
+	first.down = true
+	tx := signTestTx(t, testRecipient, 0)
+	second.mineReceipt(tx, types.ReceiptStatusSuccessful)
+	second.set(1, 1)
+	rpc := newTestRPC(t, first, second)
+
+	other := signTestTx(t, testRecipient, 1)
+	nonce, receipts, err := rpc.NonceAndReceipts(context.Background(), testAdminAddress, []string{tx.Hash().Hex(), other.Hash().Hex(), ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 1 {
+		t.Errorf("nonce = %d, want 1", nonce)
+	}
+	if len(receipts) != 3 || receipts[0] == nil || receipts[0].TxHash != tx.Hash() || receipts[1] != nil || receipts[2] != nil {
+		t.Errorf("receipts = %v, want only the receipt of %s", receipts, tx.Hash())
+	}
+	// The chain ID check, the nonce and both receipts, none from the first
+	if second.calls != 4 {
+		t.Errorf("second endpoint answered %d calls, want 4", second.calls)
+	}
+}
@@ -0,0 +1,327 @@
+package ethcashier
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// A token sweep is paid for with ETH on the deposit address. When the
+// address holds too little, the admin wallet sends it the shortfall first.
+// That ETH stays reserved for gas, so Check does not credit it to the user.
+// A sweep rarely spends its whole fee cap, so what it leaves behind stays in
+// the address's gas reserve on that chain and pays for the next token
+// sweep.
+
+// Gas funding statuses
+const (
+	gasFundingPending = "pending"
+	// gasFundingUsed fundings have been added to the address's gas reserve
+	gasFundingUsed = "used"
+	// gasFundingDropped fundings lost their nonce to another transaction
+	gasFundingDropped = "dropped"
+)
+
+// gasFundingTimeout is how long a token check waits for its gas funding to
+// be mined before leaving it for a later check
+const gasFundingTimeout = 2 * time.Minute
+
+// gasFunding is ETH sent from the admin wallet to a deposit address to pay
+// for sweeping a token
+type gasFunding struct {
+	ID     int64
+	UserID string
+	Chain  string
+	Asset  string
+	From   string
+	Nonce  uint64
+	Amount *big.Int
+	TxHash string
+	rawTx  string
+	// feeWei is the funding transaction's own fee, known once it is mined
+	feeWei *big.Int
+}
+
+// sendGasFunding sends amount wei from the admin wallet to the user's
+// deposit address to pay for sweeping token, recording it before it is
+// broadcast
+func (api *API) sendGasFunding(ctx context.Context, user *User, token *Token, amount *big.Int) (*gasFunding, error) {
+	var funding *gasFunding
+	var signedTx *types.Transaction
+	err := api.adminNonces.Reserve(func(nonce uint64) (err error) {
+		signedTx, err = api.rpc.SignTransferWithNonce(ctx, api.adminSigner, user.Wallet.PublicKey, amount, nonce, nil)
+		if err != nil {
+			return fmt.Errorf("failed to sign gas funding: %v", err)
+		}
+		funding, err = api.db.createGasFunding(user.ID, api.rpc.Chain(), token.Symbol, api.adminSigner.Address().Hex(), signedTx)
+		if err != nil {
+			return fmt.Errorf("failed to record gas funding: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.broadcastGasFunding(ctx, funding, signedTx); err != nil {
+		return nil, err
+	}
+	return funding, nil
+}
+
+// broadcastGasFunding sends a recorded gas funding. A funding the admin
+// wallet cannot pay for can never be mined, so it is marked dropped and no
+// longer counts towards the gas reserve, and its nonce shows up as a gap.
+// Any other failure leaves it pending for the next token check, which
+// rebroadcasts it or finds its nonce used by another transaction.
+func (api *API) broadcastGasFunding(ctx context.Context, funding *gasFunding, signedTx *types.Transaction) error {
+	err := api.rpc.SendSignedTransaction(ctx, signedTx)
+	if err == nil || strings.Contains(err.Error(), "already known") {
+		return nil
+	}
+	if strings.Contains(strings.ToLower(err.Error()), "insufficient funds") {
+		if err := api.db.setGasFundingStatus(funding.ID, gasFundingDropped); err != nil {
+			return err
+		}
+		return fmt.Errorf("admin wallet cannot pay gas funding %s: %v", funding.TxHash, err)
+	}
+	return fmt.Errorf("failed to broadcast gas funding %s: %v", funding.TxHash, err)
+}
+
+// waitForGasFunding waits for a gas funding to be mined, rebroadcasting it
+// in case it was dropped. It fails with ErrSweepPending if the funding is
+// not mined within gasFundingTimeout.
+func (api *API) waitForGasFunding(ctx context.Context, funding *gasFunding) error {
+	receipt, err := api.rpc.TransactionReceipt(ctx, funding.TxHash)
+	if err != nil {
+		return err
+	}
+	if receipt == nil {
+		// Check the receipt again, on the endpoint reporting the nonce, in
+		// case the funding was mined in between
+		mined, receipts, err := api.rpc.NonceAndReceipts(ctx, funding.From, []string{funding.TxHash})
+		if err != nil {
+			return err
+		}
+		receipt = receipts[0]
+		if receipt == nil && mined > funding.Nonce {
+			if err := api.db.setGasFundingStatus(funding.ID, gasFundingDropped); err != nil {
+				return err
+			}
+			return fmt.Errorf("gas funding %s lost its nonce to another transaction", funding.TxHash)
+		}
+	}
+	if receipt == nil {
+		signedTx, err := funding.signedTx()
+		if err != nil {
+			return err
+		}
+		if err := api.broadcastGasFunding(ctx, funding, signedTx); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, gasFundingTimeout)
+		defer cancel()
+		receipt, err = api.rpc.WaitForReceipt(ctx, funding.TxHash, 1)
+		if ctx.Err() != nil {
+			return fmt.Errorf("gas funding %s: %w", funding.TxHash, ErrSweepPending)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	funding.feeWei = new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), receipt.EffectiveGasPrice)
+	return nil
+}
+
+func (f *gasFunding) signedTx() (*types.Transaction, error) {
+	raw, err := hex.DecodeString(f.rawTx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw transaction: %v", err)
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("failed to decode transaction: %v", err)
+	}
+	return tx, nil
+}
+
+func (db *DB) createGasFunding(userID, chain, asset, from string, signedTx *types.Transaction) (*gasFunding, error) {
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	funding := &gasFunding{
+		UserID: userID,
+		Chain:  chain,
+		Asset:  asset,
+		From:   from,
+		Nonce:  signedTx.Nonce(),
+		Amount: signedTx.Value(),
+		TxHash: signedTx.Hash().Hex(),
+		rawTx:  hex.EncodeToString(raw),
+	}
+
+	result, err := db.Exec(`
+    INSERT INTO gas_fundings (user_id, chain, asset, from_address, nonce, amount_wei, tx_hash, raw_tx, status)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, chain, asset, from, funding.Nonce, funding.Amount.String(), funding.TxHash, funding.rawTx, gasFundingPending)
+	if err != nil {
+		return nil, err
+	}
+	funding.ID, err = result.LastInsertId()
+	return funding, err
+}
+
+// pendingGasFundings returns the user's gas fundings on chain that have not
+// yet paid for a token sweep, oldest first
+func (db *DB) pendingGasFundings(userID, chain string) ([]gasFunding, error) {
+	rows, err := db.Query(`
+    SELECT id, user_id, chain, asset, from_address, nonce, amount_wei, tx_hash, raw_tx
+    FROM gas_fundings WHERE user_id = ? AND chain = ? AND status = ? ORDER BY id`, userID, chain, gasFundingPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fundings []gasFunding
+	for rows.Next() {
+		var f gasFunding
+		var amount string
+		err := rows.Scan(&f.ID, &f.UserID, &f.Chain, &f.Asset, &f.From, &f.Nonce, &amount, &f.TxHash, &f.rawTx)
+		if err != nil {
+			return nil, err
+		}
+		if f.Amount, err = parseWei(amount); err != nil {
+			return nil, err
+		}
+		fundings = append(fundings, f)
+	}
+	return fundings, rows.Err()
+}
+
+// reservedGasWei returns the ETH on the user's deposit address on chain
+// that the admin wallet sent for token sweep gas
+func (db *DB) reservedGasWei(userID, chain string) (*big.Int, error) {
+	reserved, _, err := getGasReserve(db, userID, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	fundings, err := db.pendingGasFundings(userID, chain)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fundings {
+		reserved.Add(reserved, f.Amount)
+	}
+	return reserved, nil
+}
+
+// getGasReserve returns the gas reserve of the user's deposit address on
+// chain and the token sweep whose gas has not been taken out of it yet
+func getGasReserve(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, userID, chain string) (*big.Int, string, error) {
+	var stored, sweepTx string
+	err := q.QueryRow("SELECT reserve_wei, sweep_tx FROM gas_reserves WHERE user_id = ? AND chain = ?",
+		userID, chain).Scan(&stored, &sweepTx)
+	if err == sql.ErrNoRows {
+		return new(big.Int), "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	reserve, err := parseWei(stored)
+	return reserve, sweepTx, err
+}
+
+func setGasReserve(tx *sql.Tx, userID, chain string, reserve *big.Int, sweepTx string) error {
+	_, err := tx.Exec(`
+    INSERT INTO gas_reserves (user_id, chain, reserve_wei, sweep_tx) VALUES (?, ?, ?, ?)
+    ON CONFLICT(user_id, chain) DO UPDATE SET reserve_wei = excluded.reserve_wei, sweep_tx = excluded.sweep_tx`,
+		userID, chain, reserve.String(), sweepTx)
+	return err
+}
+
+// settleTokenSweepGas takes the gas the user's last token sweep on the
+// client's chain spent out of the address's gas reserve once the sweep is
+// mined. Until then the reserve still includes the sweep's gas, which Check
+// cannot credit anyway while the sweep is pending.
+func settleTokenSweepGas(ctx context.Context, db *DB, rpc *RPCClient, user *User) error {
+	reserve, sweepTx, err := getGasReserve(db, user.ID, rpc.Chain())
+	if err != nil || sweepTx == "" {
+		return err
+	}
+	receipt, err := rpc.TransactionReceipt(ctx, sweepTx)
+	if err != nil || receipt == nil {
+		return err
+	}
+
+	// Gas is paid from the reserve before any ETH the user deposited
+	reserve.Sub(reserve, new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), receipt.EffectiveGasPrice))
+	if reserve.Sign() < 0 {
+		reserve = new(big.Int)
+	}
+	_, err = db.Exec("UPDATE gas_reserves SET reserve_wei = ?, sweep_tx = '' WHERE user_id = ? AND chain = ? AND sweep_tx = ?",
+		reserve.String(), user.ID, rpc.Chain(), sweepTx)
+	return err
+}
+
+func (db *DB) setGasFundingStatus(id int64, status string) error {
+	_, err := db.Exec("UPDATE gas_fundings SET status = ? WHERE id = ?", status, id)
+	return err
+}
+
+// useGasFundingsTx moves mined gas fundings into the gas reserve of the
+// user's deposit address on chain, books the ETH they cost the cashier as a
+// fee and records sweepTxHash as the token sweep whose gas is still to be
+// settled
+func useGasFundingsTx(tx *sql.Tx, userID, chain, sweepTxHash string, fundings []gasFunding, ethPrice USD) error {
+	reserve, _, err := getGasReserve(tx, userID, chain)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fundings {
+		result, err := tx.Exec("UPDATE gas_fundings SET status = ? WHERE id = ? AND status = ?",
+			gasFundingUsed, f.ID, gasFundingPending)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// Already used
+			continue
+		}
+		reserve.Add(reserve, f.Amount)
+
+		spent := new(big.Int).Add(f.Amount, f.feeWei)
+		fee, err := weiToUSD(spent, ethPrice)
+		if err != nil {
+			return err
+		}
+		if fee == 0 {
+			continue
+		}
+		memo := fmt.Sprintf("gas for %s sweep from user %s on %s, %s wei in %s", f.Asset, f.UserID, f.Chain, spent, f.TxHash)
+		_, err = postTx(tx, LedgerFee, memo, []Posting{
+			{Account: AccountFees, Amount: fee},
+			{Account: AccountTreasury, Amount: -fee},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return setGasReserve(tx, userID, chain, reserve, sweepTxHash)
+}
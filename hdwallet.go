@@ -0,0 +1,143 @@
+package ethcashier
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// HDWallet derives user deposit wallets from a single BIP-32 master key
+// along the BIP-44 Ethereum path m/44'/60'/0'/0/i, where i is the user's
+// derivation index
+type HDWallet struct {
+	// account key at m/44'/60'/0'
+	account *hdkeychain.ExtendedKey
+	// external chain key at m/44'/60'/0'/0
+	chain *hdkeychain.ExtendedKey
+}
+
+// accountDepth is the depth of the BIP-44 account key m/44'/60'/0'
+const accountDepth = 3
+
+// NewHDWalletFromMnemonic creates an HD wallet from a BIP-39 mnemonic and
+// optional passphrase
+func NewHDWalletFromMnemonic(mnemonic, passphrase string) (*HDWallet, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mnemonic: %v", err)
+	}
+
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create master key: %v", err)
+	}
+
+	// m/44'/60'/0'
+	account := master
+	for _, i := range []uint32{
+		hdkeychain.HardenedKeyStart + 44,
+		hdkeychain.HardenedKeyStart + 60,
+		hdkeychain.HardenedKeyStart + 0,
+	} {
+		account, err = account.Derive(i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive account key: %v", err)
+		}
+	}
+
+	return newHDWallet(account)
+}
+
+// NewHDWalletFromXPub creates a watch-only HD wallet from the extended public
+// key of the account m/44'/60'/0'. It can derive deposit addresses but holds
+// no signing material.
+func NewHDWalletFromXPub(xpub string) (*HDWallet, error) {
+	account, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid xpub: %v", err)
+	}
+	if account.IsPrivate() {
+		return nil, fmt.Errorf("expected an extended public key, got a private key")
+	}
+	if account.Depth() != accountDepth {
+		return nil, fmt.Errorf("expected an account level key at depth %d, got depth %d", accountDepth, account.Depth())
+	}
+
+	return newHDWallet(account)
+}
+
+func newHDWallet(account *hdkeychain.ExtendedKey) (*HDWallet, error) {
+	// m/44'/60'/0'/0
+	chain, err := account.Derive(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive chain key: %v", err)
+	}
+	return &HDWallet{account: account, chain: chain}, nil
+}
+
+// IsWatchOnly reports whether the wallet was created from an xpub and
+// cannot sign for its addresses
+func (w *HDWallet) IsWatchOnly() bool {
+	return !w.chain.IsPrivate()
+}
+
+// AccountXPub returns the extended public key for m/44'/60'/0', which can be
+// given to a watch-only deployment
+func (w *HDWallet) AccountXPub() (string, error) {
+	xpub, err := w.account.Neuter()
+	if err != nil {
+		return "", err
+	}
+	return xpub.String(), nil
+}
+
+// Address returns the deposit address at the given derivation index
+func (w *HDWallet) Address(index uint32) (string, error) {
+	child, err := w.derive(index)
+	if err != nil {
+		return "", err
+	}
+
+	pubKey, err := child.ECPubKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to get public key: %v", err)
+	}
+	publicKeyECDSA, err := crypto.UnmarshalPubkey(pubKey.SerializeUncompressed())
+	if err != nil {
+		return "", fmt.Errorf("failed to parse public key: %v", err)
+	}
+	return crypto.PubkeyToAddress(*publicKeyECDSA).Hex(), nil
+}
+
+// PrivateKey returns the signing key for the deposit address at index
+func (w *HDWallet) PrivateKey(index uint32) (*ecdsa.PrivateKey, error) {
+	if w.IsWatchOnly() {
+		return nil, fmt.Errorf("watch-only wallet cannot derive private keys")
+	}
+
+	child, err := w.derive(index)
+	if err != nil {
+		return nil, err
+	}
+
+	privKey, err := child.ECPrivKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private key: %v", err)
+	}
+	return crypto.ToECDSA(privKey.Serialize())
+}
+
+func (w *HDWallet) derive(index uint32) (*hdkeychain.ExtendedKey, error) {
+	if index >= hdkeychain.HardenedKeyStart {
+		return nil, fmt.Errorf("derivation index %d out of range", index)
+	}
+	child, err := w.chain.Derive(index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key %d: %v", index, err)
+	}
+	return child, nil
+}
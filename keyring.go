@@ -0,0 +1,217 @@
+package ethcashier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Keyring holds the versioned keys used to encrypt user wallet private keys.
+// New ciphertexts are always sealed under the current version, while older
+// versions are kept around so existing rows can still be decrypted until a
+// rotation has re-encrypted them.
+type Keyring struct {
+	current byte
+	keys    map[byte][]byte
+}
+
+// NewKeyring creates a keyring whose current key is key at the given version
+func NewKeyring(version byte, key []byte) *Keyring {
+	return &Keyring{
+		current: version,
+		keys:    map[byte][]byte{version: key},
+	}
+}
+
+// AddKey registers a previous key version that can still be used for decryption
+func (k *Keyring) AddKey(version byte, key []byte) {
+	k.keys[version] = key
+}
+
+// CurrentVersion returns the version new ciphertexts are sealed under
+func (k *Keyring) CurrentVersion() byte {
+	return k.current
+}
+
+// Encrypt encrypts a hex private key under the current key version
+func (k *Keyring) Encrypt(privateKeyHex string) (string, error) {
+	return encryptPrivateKey(privateKeyHex, k.current, k.keys[k.current])
+}
+
+// Decrypt decrypts a stored private key with whichever key version sealed it
+func (k *Keyring) Decrypt(encryptedKey string) (string, error) {
+	version, _, err := splitCiphertext(encryptedKey)
+	if err != nil {
+		return "", err
+	}
+	key, ok := k.keys[version]
+	if !ok {
+		return "", fmt.Errorf("no key loaded for version %d", version)
+	}
+	return decryptPrivateKey(encryptedKey, key)
+}
+
+// needsRotation reports whether an encrypted key was sealed under an older version
+func (k *Keyring) needsRotation(encryptedKey string) (bool, error) {
+	version, _, err := splitCiphertext(encryptedKey)
+	if err != nil {
+		return false, err
+	}
+	return version != k.current, nil
+}
+
+// Keys used in the settings table for key versioning
+const (
+	settingKeyVersion = "key_version"
+	keyCheckMessage   = "eth_cashier key check"
+)
+
+func keySaltSetting(version byte) string {
+	// Version 1 keeps the salt stored before key versioning existed
+	if version == 1 {
+		return settingKeySalt
+	}
+	return fmt.Sprintf("%s_v%d", settingKeySalt, version)
+}
+
+func keyCheckSetting(version byte) string {
+	return fmt.Sprintf("key_check_v%d", version)
+}
+
+// keyCheck returns a value that identifies a key without revealing it
+func keyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyCheckMessage))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deriveVersionKey derives the key for password at version and reports
+// whether it matches the key check stored for that version
+func (db *DB) deriveVersionKey(password string, version byte) ([]byte, bool, error) {
+	salt, err := db.getKeySalt(keySaltSetting(version))
+	if err != nil {
+		return nil, false, err
+	}
+	key, err := DeriveSecretKey(password, salt)
+	if err != nil {
+		return nil, false, err
+	}
+	check, err := db.getSetting(keyCheckSetting(version))
+	if err != nil {
+		return nil, false, err
+	}
+	if check == "" {
+		// No check stored yet, as in databases encrypted before key checks
+		// existed. Only record one once the key opens a stored wallet key, so
+		// a mistyped password is never pinned as the key for this version.
+		ok, err := db.decryptsStoredKey(key, version)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		if err := db.setSetting(keyCheckSetting(version), keyCheck(key)); err != nil {
+			return nil, false, err
+		}
+		return key, true, nil
+	}
+	return key, hmac.Equal([]byte(check), []byte(keyCheck(key))), nil
+}
+
+// decryptsStoredKey reports whether key decrypts a wallet key sealed under
+// version, or true if no wallet key is sealed under it yet
+func (db *DB) decryptsStoredKey(key []byte, version byte) (bool, error) {
+	rows, err := db.Query("SELECT encrypted_private_key FROM users WHERE encrypted_private_key != ''")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var encryptedKey string
+		if err := rows.Scan(&encryptedKey); err != nil {
+			return false, err
+		}
+		if isPlaintextPrivateKey(encryptedKey) {
+			continue
+		}
+		sealedUnder, _, err := splitCiphertext(encryptedKey)
+		if err != nil || sealedUnder != version {
+			continue
+		}
+		_, err = decryptPrivateKey(encryptedKey, key)
+		return err == nil, nil
+	}
+	return true, rows.Err()
+}
+
+// LoadKeyring builds the keyring from the secret password and, during a
+// rotation, the previous password.
+//
+// If password matches the current key version it is used as is. If it does
+// not, previousPassword must match the current version; password then becomes
+// a new key version and existing rows remain decryptable under the previous
+// key until RotateWalletKeys has re-encrypted them.
+func LoadKeyring(db *DB, password, previousPassword string) (*Keyring, error) {
+	stored, err := db.getSetting(settingKeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	current := byte(1)
+	if stored != "" {
+		v, err := strconv.ParseUint(stored, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key version %q: %v", stored, err)
+		}
+		current = byte(v)
+	} else if err := db.setSetting(settingKeyVersion, "1"); err != nil {
+		return nil, err
+	}
+
+	key, ok, err := db.deriveVersionKey(password, current)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		keyring := NewKeyring(current, key)
+		if previousPassword != "" && current > 1 {
+			previousKey, ok, err := db.deriveVersionKey(previousPassword, current-1)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("previous password does not match key version %d", current-1)
+			}
+			keyring.AddKey(current-1, previousKey)
+		}
+		return keyring, nil
+	}
+
+	// The password does not match the current version, so this is a rotation
+	if previousPassword == "" {
+		return nil, fmt.Errorf("secret password does not match key version %d; set the previous password to rotate", current)
+	}
+	previousKey, ok, err := db.deriveVersionKey(previousPassword, current)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("neither password matches key version %d", current)
+	}
+	if current == 255 {
+		return nil, fmt.Errorf("key version limit reached")
+	}
+
+	next := current + 1
+	key, _, err = db.deriveVersionKey(password, next)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.setSetting(settingKeyVersion, strconv.Itoa(int(next))); err != nil {
+		return nil, err
+	}
+
+	keyring := NewKeyring(next, key)
+	keyring.AddKey(current, previousKey)
+	return keyring, nil
+}
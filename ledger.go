@@ -0,0 +1,326 @@
+package ethcashier
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Every balance change is recorded as a ledger transaction of two or more
+// entries whose amounts sum to zero. Amounts are signed: positive amounts
+// debit an account and negative amounts credit it. User accounts are
+// liabilities, so a user's balance is the negated sum of their entries and
+// is cached in users.balance_micros in the same database transaction.
+
+// Ledger accounts other than per-user accounts
+const (
+	// AccountTreasury is the ETH held by the cashier, at its booked USD value.
+	// Tokens are held in per-token treasury accounts, see TokenTreasury.
+	AccountTreasury = "treasury"
+	// AccountFees is network fees paid by the cashier
+	AccountFees = "fees"
+	// AccountFX is gains and losses from revaluing the treasury at market price
+	AccountFX = "fx"
+)
+
+// Ledger transaction kinds
+const (
+	LedgerOpeningBalance   = "opening_balance"
+	LedgerDeposit          = "deposit"
+	LedgerDepositReversal  = "deposit_reversal"
+	LedgerWithdrawal       = "withdrawal"
+	LedgerWithdrawalRefund = "withdrawal_refund"
+	LedgerFee              = "fee"
+	LedgerRevaluation      = "revaluation"
+)
+
+const userAccountPrefix = "user:"
+
+// UserAccount returns the ledger account holding a user's balance
+func UserAccount(userID string) string {
+	return userAccountPrefix + userID
+}
+
+// Posting is a single debit (positive) or credit (negative) to an account
+type Posting struct {
+	Account string
+	Amount  USD
+}
+
+// LedgerEntry is a row of the ledger_entries table
+type LedgerEntry struct {
+	ID        int64
+	TxnID     string
+	Kind      string
+	Account   string
+	Amount    USD
+	Memo      string
+	CreatedAt time.Time
+}
+
+// Post records a balanced ledger transaction and returns its id. It fails
+// with ErrInsufficientFunds if any user balance would go negative.
+func (db *DB) Post(kind, memo string, postings ...Posting) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	txnID, err := postTx(tx, kind, memo, postings)
+	if err != nil {
+		return "", err
+	}
+	return txnID, tx.Commit()
+}
+
+func depositPostings(treasury, userID string, amount USD) []Posting {
+	return []Posting{
+		{Account: treasury, Amount: amount},
+		{Account: UserAccount(userID), Amount: -amount},
+	}
+}
+
+// postTx writes a ledger transaction inside tx and updates the cached
+// balances of any user accounts it touches
+func postTx(tx *sql.Tx, kind, memo string, postings []Posting) (string, error) {
+	if len(postings) < 2 {
+		return "", fmt.Errorf("ledger transaction needs at least two postings")
+	}
+	var sum USD
+	for _, p := range postings {
+		sum += p.Amount
+	}
+	if sum != 0 {
+		return "", fmt.Errorf("ledger transaction is unbalanced by %s", sum)
+	}
+
+	txnID := uuid.New().String()
+	for _, p := range postings {
+		if p.Amount == 0 {
+			continue
+		}
+		_, err := tx.Exec(`
+        INSERT INTO ledger_entries (txn_id, kind, account, amount_micros, memo)
+        VALUES (?, ?, ?, ?, ?)`, txnID, kind, p.Account, p.Amount, memo)
+		if err != nil {
+			return "", err
+		}
+
+		userID, ok := strings.CutPrefix(p.Account, userAccountPrefix)
+		if !ok {
+			continue
+		}
+		// A debit lowers the user's balance, a credit raises it
+		result, err := tx.Exec("UPDATE users SET balance_micros = balance_micros - ? WHERE id = ?", p.Amount, userID)
+		if err != nil {
+			return "", err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return "", fmt.Errorf("user %s not found", userID)
+		}
+
+		var balance USD
+		err = tx.QueryRow("SELECT balance_micros FROM users WHERE id = ?", userID).Scan(&balance)
+		if err != nil {
+			return "", err
+		}
+		if balance < 0 {
+			return "", ErrInsufficientFunds
+		}
+	}
+	return txnID, nil
+}
+
+// AccountBalance returns the sum of all entries for account, positive for a
+// net debit
+func (db *DB) AccountBalance(account string) (USD, error) {
+	var balance USD
+	err := db.QueryRow("SELECT COALESCE(SUM(amount_micros), 0) FROM ledger_entries WHERE account = ?", account).Scan(&balance)
+	return balance, err
+}
+
+// ListLedgerEntries returns the entries posted to account, oldest first
+func (db *DB) ListLedgerEntries(account string) ([]LedgerEntry, error) {
+	rows, err := db.Query(`
+    SELECT id, txn_id, kind, account, amount_micros, memo, created_at
+    FROM ledger_entries WHERE account = ? ORDER BY id`, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		err := rows.Scan(&e.ID, &e.TxnID, &e.Kind, &e.Account, &e.Amount, &e.Memo, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// VerifyLedger checks that every ledger transaction balances and that every
+// cached user balance matches the user's ledger account
+func (db *DB) VerifyLedger() error {
+	var unbalanced string
+	err := db.QueryRow(`
+    SELECT txn_id FROM ledger_entries
+    GROUP BY txn_id HAVING SUM(amount_micros) != 0 LIMIT 1`).Scan(&unbalanced)
+	if err == nil {
+		return fmt.Errorf("ledger transaction %s does not balance", unbalanced)
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	rows, err := db.Query(`
+    SELECT u.id, u.balance_micros, COALESCE(-SUM(l.amount_micros), 0)
+    FROM users u LEFT JOIN ledger_entries l ON l.account = 'user:' || u.id
+    GROUP BY u.id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var cached, ledger USD
+		if err := rows.Scan(&id, &cached, &ledger); err != nil {
+			return err
+		}
+		if cached != ledger {
+			return fmt.Errorf("user %s balance %s does not match ledger balance %s", id, cached, ledger)
+		}
+	}
+	return rows.Err()
+}
+
+// RevalueTreasury books the difference between the market value of the ETH
+// held by the cashier and the treasury's booked value as an FX gain or loss.
+// The treasury is the admin wallet on every chain in rpcs plus credited
+// funds still held on watch-only deposit addresses. It returns the amount
+// booked, positive for a gain.
+func RevalueTreasury(ctx context.Context, db *DB, rpcs []*RPCClient, cmc *CMCClient, adminAddress string) (USD, error) {
+	treasuryWei := new(big.Int)
+	for _, rpc := range rpcs {
+		balance, err := rpc.GetBalance(ctx, adminAddress)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get admin balance on %s: %v", rpc.Chain(), err)
+		}
+		treasuryWei.Add(treasuryWei, balance)
+	}
+
+	rows, err := db.Query("SELECT unswept_wei FROM unswept_balances WHERE unswept_wei != '0'")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		unswept, err := parseWei(stored)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		treasuryWei = new(big.Int).Add(treasuryWei, unswept)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	ethPrice, err := cmc.GetEthereumPrice(ctx)
+	if err != nil {
+		return 0, err
+	}
+	booked, err := db.AccountBalance(AccountTreasury)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := weiToUSD(treasuryWei, ethPrice)
+	if err != nil {
+		return 0, err
+	}
+	gain := value - booked
+	if gain == 0 {
+		return 0, nil
+	}
+	memo := fmt.Sprintf("treasury %s wei at %s USD/ETH", treasuryWei, ethPrice)
+	_, err = db.Post(LedgerRevaluation, memo,
+		Posting{Account: AccountTreasury, Amount: gain},
+		Posting{Account: AccountFX, Amount: -gain})
+	if err != nil {
+		return 0, err
+	}
+	return gain, nil
+}
+
+// openLedger posts an opening balance for every user whose balance predates
+// the ledger, so the cached balances and the ledger agree
+func openLedger(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var opened string
+	err = tx.QueryRow("SELECT value FROM settings WHERE key = ?", settingLedgerOpened).Scan(&opened)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, balance_micros FROM users WHERE balance_micros != 0")
+	if err != nil {
+		return err
+	}
+	balances := make(map[string]USD)
+	for rows.Next() {
+		var id string
+		var balance USD
+		if err := rows.Scan(&id, &balance); err != nil {
+			rows.Close()
+			return err
+		}
+		balances[id] = balance
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, balance := range balances {
+		txnID := uuid.New().String()
+		for _, p := range depositPostings(AccountTreasury, id, balance) {
+			// The cached balance already holds the amount, so only the
+			// entries are written
+			_, err := tx.Exec(`
+            INSERT INTO ledger_entries (txn_id, kind, account, amount_micros, memo)
+            VALUES (?, ?, ?, ?, ?)`, txnID, LedgerOpeningBalance, p.Account, p.Amount, "balance before ledger")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO settings (key, value) VALUES (?, ?)", settingLedgerOpened, "1")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,137 @@
+package ethcashier
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB opens an empty database in a temporary directory
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "cashier.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestUser stores a user with a placeholder deposit address
+func newTestUser(t *testing.T, db *DB, id string) *User {
+	t.Helper()
+	user := &User{ID: id, Wallet: wallet{PublicKey: "0x" + id}}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestPostTx(t *testing.T) {
+	tests := []struct {
+		name     string
+		postings []Posting
+		wantErr  bool
+		target   error
+	}{
+		{
+			name:     "balanced deposit",
+			postings: depositPostings(AccountTreasury, "alice", 5*MicrosPerDollar),
+		},
+		{
+			name: "three way",
+			postings: []Posting{
+				{Account: AccountTreasury, Amount: 3 * MicrosPerDollar},
+				{Account: AccountFees, Amount: 1 * MicrosPerDollar},
+				{Account: UserAccount("alice"), Amount: -4 * MicrosPerDollar},
+			},
+		},
+		{
+			name: "unbalanced",
+			postings: []Posting{
+				{Account: AccountTreasury, Amount: 5 * MicrosPerDollar},
+				{Account: UserAccount("alice"), Amount: -4 * MicrosPerDollar},
+			},
+			wantErr: true,
+		},
+		{
+			name:     "single posting",
+			postings: []Posting{{Account: AccountTreasury, Amount: 0}},
+			wantErr:  true,
+		},
+		{
+			name: "overdrawn user",
+			postings: []Posting{
+				{Account: UserAccount("alice"), Amount: MicrosPerDollar},
+				{Account: AccountTreasury, Amount: -MicrosPerDollar},
+			},
+			wantErr: true,
+			target:  ErrInsufficientFunds,
+		},
+		{
+			name:     "unknown user",
+			postings: depositPostings(AccountTreasury, "bob", MicrosPerDollar),
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		newTestUser(t, db, "alice")
+
+		_, err := db.Post(LedgerDeposit, tt.name, tt.postings...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Post error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.target != nil && !errors.Is(err, tt.target) {
+			t.Errorf("%s: Post error = %v, want %v", tt.name, err, tt.target)
+		}
+		if tt.wantErr {
+			// Nothing of a rejected transaction may be written
+			if balance, _ := db.AccountBalance(AccountTreasury); balance != 0 {
+				t.Errorf("%s: treasury balance = %s after a rejected post", tt.name, balance)
+			}
+		}
+		if err := db.VerifyLedger(); err != nil {
+			t.Errorf("%s: VerifyLedger: %v", tt.name, err)
+		}
+	}
+}
+
+func TestVerifyLedger(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  string
+		wantErr bool
+	}{
+		{name: "consistent"},
+		{
+			name:    "cached balance drifted",
+			tamper:  "UPDATE users SET balance_micros = balance_micros + 1 WHERE id = 'alice'",
+			wantErr: true,
+		},
+		{
+			name: "unbalanced transaction",
+			tamper: `INSERT INTO ledger_entries (txn_id, kind, account, amount_micros, memo)
+                VALUES ('broken', 'fee', 'fees', 1, '')`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		newTestUser(t, db, "alice")
+		if _, err := db.Post(LedgerDeposit, "", depositPostings(AccountTreasury, "alice", 5*MicrosPerDollar)...); err != nil {
+			t.Fatal(err)
+		}
+		if tt.tamper != "" {
+			if _, err := db.Exec(tt.tamper); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := db.VerifyLedger()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: VerifyLedger error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
+	"time"
 
 	ethcashier "github.com/gotsteez/eth_cashier"
 	"github.com/joho/godotenv"
@@ -12,7 +15,7 @@ import (
 
 func main() {
 	if err := godotenv.Load("./configs/.env"); err != nil {
-		log.Fatalf("env could not be loaded correctly", err)
+		log.Fatalf("env could not be loaded correctly: %v", err)
 	}
 	dbPath := "database.db"
 	// Check if database file exists
@@ -30,16 +33,69 @@ func main() {
 		fmt.Printf("Failed to initialize database: %v\n", err)
 		return
 	}
+	if err := db.VerifyLedger(); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+	// Background work runs until the process exits; requests are bounded
+	// by their own context
+	ctx := context.Background()
 
-	rpcURL := os.Getenv("RPC_URL")
-	if rpcURL == "" {
-		fmt.Println("RPC URL is missing from env variables")
-		return
+	secretPassword := os.Getenv("SECRET_PASSWORD")
+	if secretPassword == "" {
+		log.Fatal("SECRET_PASSWORD is missing from env variables")
 	}
-	rpc, err := ethcashier.NewRPCClient(rpcURL)
+	// SECRET_PASSWORD_PREVIOUS is only set while rotating to a new password
+	keyring, err := ethcashier.LoadKeyring(db, secretPassword, os.Getenv("SECRET_PASSWORD_PREVIOUS"))
 	if err != nil {
-		fmt.Printf("Failed to initialize rpc client: %v\n", err)
-		return
+		log.Fatalf("Failed to load wallet keys: %v", err)
+	}
+	migrated, err := db.EncryptPlaintextKeys(keyring)
+	if err != nil {
+		log.Fatalf("Failed to encrypt plaintext wallet keys: %v", err)
+	}
+	if migrated > 0 {
+		log.Printf("encrypted %d plaintext wallet keys", migrated)
+	}
+	go func() {
+		rotated, err := db.RotateWalletKeys(keyring, 100)
+		if err != nil {
+			log.Printf("wallet key rotation failed: %v", err)
+			return
+		}
+		if rotated > 0 {
+			log.Printf("re-encrypted %d wallet keys under key version %d, SECRET_PASSWORD_PREVIOUS can now be removed", rotated, keyring.CurrentVersion())
+		}
+	}()
+
+	// WALLET_XPUB runs the server watch-only, with no deposit signing keys
+	var hd *ethcashier.HDWallet
+	mnemonic := os.Getenv("WALLET_MNEMONIC")
+	xpub := os.Getenv("WALLET_XPUB")
+	switch {
+	case mnemonic != "" && xpub != "":
+		log.Fatal("Only one of WALLET_MNEMONIC and WALLET_XPUB can be set")
+	case xpub != "":
+		hd, err = ethcashier.NewHDWalletFromXPub(xpub)
+		log.Println("running in watch-only mode, deposits will not be swept")
+	case mnemonic != "":
+		hd, err = ethcashier.NewHDWalletFromMnemonic(mnemonic, os.Getenv("WALLET_MNEMONIC_PASSPHRASE"))
+	default:
+		log.Fatal("WALLET_MNEMONIC or WALLET_XPUB is missing from env variables")
+	}
+	if err != nil {
+		log.Fatalf("Failed to load HD wallet: %v", err)
+	}
+	if err := db.VerifyDerivedAddresses(hd); err != nil {
+		log.Fatalf("HD wallet does not match existing users: %v", err)
+	}
+
+	chains, err := ethcashier.ChainsFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to load chains: %v", err)
+	}
+	// Rows recorded before multi-chain support belong to the primary chain
+	if err := db.AdoptLegacyRows(chains[0].Name); err != nil {
+		log.Fatalf("Failed to assign existing records to chain %s: %v", chains[0].Name, err)
 	}
 
 	cmcAPIKey := os.Getenv("CMC_API_KEY")
@@ -48,21 +104,168 @@ func main() {
 		return
 	}
 	cmc := ethcashier.NewCMCClient(cmcAPIKey)
-
-	adminPrivateKey := os.Getenv("ADMIN_WALLET_PRIV_KEY")
-	if adminPrivateKey == "" {
-		log.Fatal("No admin private key foudn in env")
+	if timeout := os.Getenv("PRICE_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid PRICE_TIMEOUT %q", timeout)
+		}
+		cmc.SetTimeout(d)
+	}
+	rpcTimeout := ethcashier.DefaultRPCTimeout
+	if timeout := os.Getenv("RPC_TIMEOUT"); timeout != "" {
+		rpcTimeout, err = time.ParseDuration(timeout)
+		if err != nil || rpcTimeout <= 0 {
+			log.Fatalf("Invalid RPC_TIMEOUT %q", timeout)
+		}
 	}
 
-	adminWallet, err := ethcashier.ParseECDSAPrivateKeyFromHex(adminPrivateKey)
+	adminSigner, err := ethcashier.AdminSignerFromEnv()
 	if err != nil {
-		log.Fatalf("Admin wallet parse error: %v", err)
+		log.Fatalf("Failed to load admin wallet: %v", err)
+	}
+	if os.Getenv("ADMIN_REMOTE_SIGNER_URL") == "" && os.Getenv("ADMIN_KEYSTORE_PATH") == "" {
+		log.Println("warning: admin key loaded from plaintext env, use ADMIN_KEYSTORE_PATH in production")
+	}
+	var minDeposit *big.Int
+	if wei := os.Getenv("MIN_DEPOSIT_WEI"); wei != "" {
+		var ok bool
+		minDeposit, ok = new(big.Int).SetString(wei, 10)
+		if !ok || minDeposit.Sign() < 0 {
+			log.Fatalf("Invalid MIN_DEPOSIT_WEI %q", wei)
+		}
+	}
+
+	// Each chain gets its own client, admin nonces and API over the shared
+	// database, price feed and wallets
+	apis := make([]*ethcashier.API, len(chains))
+	rpcs := make([]*ethcashier.RPCClient, len(chains))
+	nonces := make([]*ethcashier.NonceManager, len(chains))
+	for i, chain := range chains {
+		rpc, err := ethcashier.DialChain(ctx, chain)
+		if err != nil {
+			log.Fatalf("Failed to initialize rpc client for %s: %v", chain.Name, err)
+		}
+		rpc.SetTimeout(rpcTimeout)
+		if err := rpc.CheckHealth(ctx); err != nil {
+			log.Printf("WARNING: %s: %v", chain.Name, err)
+		}
+		// Withdrawals share the admin wallet, so its nonces are allocated centrally
+		adminNonces, err := ethcashier.NewNonceManager(ctx, db, rpc, adminSigner.Address().Hex())
+		if err != nil {
+			log.Fatalf("Failed to sync admin wallet nonce on %s: %v", chain.Name, err)
+		}
+		logNonceGaps(ctx, chain.Name, adminNonces)
+
+		api := ethcashier.NewAPI(db, cmc, rpc, adminSigner, adminNonces, keyring, hd)
+		if minDeposit != nil {
+			api.SetMinDeposit(minDeposit)
+		}
+		tokens, err := ethcashier.ParseTokens(chain.Tokens)
+		if err != nil {
+			log.Fatalf("Invalid tokens for %s: %v", chain.Name, err)
+		}
+		if len(tokens) > 0 && hd.IsWatchOnly() {
+			log.Fatal("ERC-20 tokens cannot be accepted in watch-only mode")
+		}
+		api.SetTokens(tokens)
+		api.SetStartBlock(chain.StartBlock)
+		if chain.Confirmations > 0 {
+			if err := api.SetConfirmations(chain.Confirmations); err != nil {
+				log.Fatalf("Invalid confirmations for %s: %v", chain.Name, err)
+			}
+		}
+		apis[i], rpcs[i], nonces[i] = api, rpc, adminNonces
+	}
+
+	// Withdrawals pending for longer than this are replaced with higher fees
+	stuckTimeout := 10 * time.Minute
+	if timeout := os.Getenv("STUCK_TX_TIMEOUT"); timeout != "" {
+		stuckTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatalf("Invalid STUCK_TX_TIMEOUT: %v", err)
+		}
+	}
+
+	// Deposits are swept as the blocks paying them are confirmed, resuming
+	// from the last scanned block after a restart, credited once their sweep
+	// is mined, and reversed if their block is reorged out
+	depositPollInterval := 15 * time.Second
+	if interval := os.Getenv("DEPOSIT_POLL_INTERVAL"); interval != "" {
+		depositPollInterval, err = time.ParseDuration(interval)
+		if err != nil || depositPollInterval <= 0 {
+			log.Fatalf("Invalid DEPOSIT_POLL_INTERVAL %q", interval)
+		}
+	}
+	for i := range chains {
+		api, rpc, adminNonces, name := apis[i], rpcs[i], nonces[i], chains[i].Name
+		go func() {
+			// Catch up on deposits made while the server was down or that the
+			// watcher cannot see
+			if funded, err := api.CheckAll(ctx); err != nil {
+				log.Printf("deposit check of all users on %s failed: %v", name, err)
+			} else {
+				log.Printf("checked %d deposit addresses holding ETH on %s", funded, name)
+			}
+
+			ticker := time.NewTicker(depositPollInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := api.ScanDeposits(ctx); err != nil {
+					log.Printf("deposit scan on %s failed: %v", name, err)
+				}
+				if err := ethcashier.SettleDeposits(ctx, db, rpc); err != nil {
+					log.Printf("deposit settlement on %s failed: %v", name, err)
+				}
+				if err := ethcashier.CheckDepositReorgs(ctx, db, rpc); err != nil {
+					log.Printf("deposit reorg check on %s failed: %v", name, err)
+				}
+			}
+		}()
+
+		// Rank the chain's RPC endpoints by head lag, latency and errors
+		go func() {
+			ticker := time.NewTicker(30 * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := rpc.CheckHealth(ctx); err != nil {
+					log.Printf("WARNING: %s: %v", name, err)
+				}
+			}
+		}()
+
+		// Confirm, rebroadcast, speed up or refund withdrawals in the background
+		go func() {
+			ticker := time.NewTicker(30 * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := ethcashier.TrackWithdrawals(ctx, db, rpc); err != nil {
+					log.Printf("withdrawal tracking on %s failed: %v", name, err)
+				}
+				if err := ethcashier.SpeedUpWithdrawals(ctx, db, rpc, adminSigner, adminNonces, stuckTimeout); err != nil {
+					log.Printf("withdrawal speed up on %s failed: %v", name, err)
+				}
+				logNonceGaps(ctx, name, adminNonces)
+			}
+		}()
 	}
-	api := ethcashier.NewAPI(db, cmc, rpc, adminWallet)
-	api.SetupRoutes()
+	ethcashier.NewCashier(apis...).SetupRoutes()
 
 	log.Println("server up and running")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
 		log.Fatalf("failed to start server: %v", err)
 	}
 }
+
+// logNonceGaps warns about admin wallet nonces on the named chain that no
+// pending transaction holds, since they block every later withdrawal from
+// being mined
+func logNonceGaps(ctx context.Context, chain string, nonces *ethcashier.NonceManager) {
+	gaps, err := nonces.Gaps(ctx)
+	if err != nil {
+		log.Printf("failed to check admin nonce gaps on %s: %v", chain, err)
+		return
+	}
+	if len(gaps) > 0 {
+		log.Printf("WARNING: admin wallet %s has nonce gaps %v on %s, later withdrawals cannot be mined until they are filled", nonces.Address(), gaps, chain)
+	}
+}
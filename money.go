@@ -0,0 +1,120 @@
+package ethcashier
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// USD is an exact amount of US dollars, stored as an integer number of
+// micro-dollars (millionths of a dollar) so balances never drift
+type USD int64
+
+// MicrosPerDollar is the number of micro-dollars in one dollar
+const MicrosPerDollar = 1000000
+
+// ParseUSD parses a decimal dollar amount such as "12.34". Amounts with more
+// precision than a micro-dollar are rejected rather than rounded.
+func ParseUSD(s string) (USD, error) {
+	micros, exact, err := parseMicros(s)
+	if err != nil {
+		return 0, err
+	}
+	if !exact {
+		return 0, fmt.Errorf("amount %q has more than 6 decimal places", s)
+	}
+	return micros, nil
+}
+
+// parseMicros parses a decimal amount into micro-dollars, truncating any
+// extra precision and reporting whether the conversion was exact
+func parseMicros(s string) (USD, bool, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, false, fmt.Errorf("invalid amount %q", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt64(MicrosPerDollar))
+
+	micros := new(big.Int).Quo(r.Num(), r.Denom())
+	if !micros.IsInt64() {
+		return 0, false, fmt.Errorf("amount %q out of range", s)
+	}
+	return USD(micros.Int64()), r.IsInt(), nil
+}
+
+// usdFromFloat converts a legacy floating point dollar amount, rounding to
+// the nearest micro-dollar
+func usdFromFloat(f float64) USD {
+	return USD(math.Round(f * MicrosPerDollar))
+}
+
+// String formats the amount in dollars without trailing zeros, e.g. "12.5"
+func (u USD) String() string {
+	sign := ""
+	micros := int64(u)
+	if micros < 0 {
+		sign = "-"
+		micros = -micros
+	}
+	whole := micros / MicrosPerDollar
+	frac := micros % MicrosPerDollar
+	if frac == 0 {
+		return fmt.Sprintf("%s%d", sign, whole)
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%06d", sign, whole, frac), "0")
+}
+
+// MarshalJSON encodes the amount as an exact JSON number
+func (u USD) MarshalJSON() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a decimal string
+func (u *USD) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	parsed, err := ParseUSD(s)
+	if err != nil {
+		return err
+	}
+	*u = parsed
+	return nil
+}
+
+// weiToUSD converts a wei amount to USD at the given price per ETH,
+// rounding down
+func weiToUSD(wei *big.Int, ethPrice USD) (USD, error) {
+	return unitsToUSD(wei, 18, ethPrice)
+}
+
+// unitsToUSD converts an amount of a token's smallest unit to USD at the
+// given price per whole token, rounding down. It fails if the result does
+// not fit in a USD amount.
+func unitsToUSD(units *big.Int, decimals uint8, price USD) (USD, error) {
+	micros := new(big.Int).Mul(units, big.NewInt(int64(price)))
+	micros.Quo(micros, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	if !micros.IsInt64() {
+		return 0, fmt.Errorf("%s base units at %s USD is out of range", units, price)
+	}
+	return USD(micros.Int64()), nil
+}
+
+// usdToWei converts a USD amount to wei at the given price per ETH,
+// rounding down
+func usdToWei(amount USD, ethPrice USD) (*big.Int, error) {
+	return usdToUnits(amount, 18, ethPrice)
+}
+
+// usdToUnits converts a USD amount to a token's smallest unit at the given
+// price per whole token, rounding down
+func usdToUnits(amount USD, decimals uint8, price USD) (*big.Int, error) {
+	if price <= 0 {
+		return nil, fmt.Errorf("invalid price %s", price)
+	}
+	units := new(big.Int).Mul(big.NewInt(int64(amount)), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+	return units.Quo(units, big.NewInt(int64(price))), nil
+}
@@ -0,0 +1,158 @@
+package ethcashier
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestParseUSD(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    USD
+		wantErr bool
+	}{
+		{in: "12.34", want: 12340000},
+		{in: " 1 ", want: MicrosPerDollar},
+		{in: "0.000001", want: 1},
+		{in: "-5.5", want: -5500000},
+		{in: "0.0000001", wantErr: true},
+		{in: "1.2345678", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "10000000000000", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseUSD(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseUSD(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseUSD(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUSDString(t *testing.T) {
+	tests := []struct {
+		in   USD
+		want string
+	}{
+		{in: 0, want: "0"},
+		{in: 12500000, want: "12.5"},
+		{in: 1, want: "0.000001"},
+		{in: -2000000, want: "-2"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("USD(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestWeiToUSD(t *testing.T) {
+	ether := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	tests := []struct {
+		name  string
+		wei   *big.Int
+		price USD
+		want  USD
+	}{
+		{name: "one ether", wei: ether, price: 2000 * MicrosPerDollar, want: 2000 * MicrosPerDollar},
+		{name: "zero", wei: new(big.Int), price: 2000 * MicrosPerDollar, want: 0},
+		// 1e12 wei at $1.999999 is 1.999999 micro-dollars
+		{name: "rounds down", wei: big.NewInt(1e12), price: 1999999, want: 1},
+		{name: "below a micro-dollar", wei: big.NewInt(1e11), price: 9 * MicrosPerDollar, want: 0},
+	}
+	for _, tt := range tests {
+		got, err := weiToUSD(tt.wei, tt.price)
+		if err != nil {
+			t.Errorf("%s: weiToUSD error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: weiToUSD = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnitsToUSD(t *testing.T) {
+	tests := []struct {
+		name     string
+		units    *big.Int
+		decimals uint8
+		price    USD
+		want     USD
+		wantErr  bool
+	}{
+		{name: "stablecoin", units: big.NewInt(1500000), decimals: 6, price: MicrosPerDollar, want: 1500000},
+		{name: "no decimals", units: big.NewInt(3), decimals: 0, price: 2 * MicrosPerDollar, want: 6 * MicrosPerDollar},
+		// 1 unit of an 8 decimal token at $0.5 is 0.005 micro-dollars
+		{name: "rounds down", units: big.NewInt(1), decimals: 8, price: MicrosPerDollar / 2, want: 0},
+		{name: "overflow", units: new(big.Int).Exp(big.NewInt(10), big.NewInt(40), nil), decimals: 6, price: MicrosPerDollar, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := unitsToUSD(tt.units, tt.decimals, tt.price)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unitsToUSD error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: unitsToUSD = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUSDToWei(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  USD
+		price   USD
+		want    string
+		wantErr bool
+	}{
+		{name: "half an ether", amount: 1000 * MicrosPerDollar, price: 2000 * MicrosPerDollar, want: "500000000000000000"},
+		// $1 at $3 is 0.333... ETH
+		{name: "rounds down", amount: MicrosPerDollar, price: 3 * MicrosPerDollar, want: "333333333333333333"},
+		{name: "zero price", amount: MicrosPerDollar, price: 0, wantErr: true},
+		{name: "negative price", amount: MicrosPerDollar, price: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := usdToWei(tt.amount, tt.price)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: usdToWei error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("%s: usdToWei = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUSDToUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   USD
+		decimals uint8
+		price    USD
+		want     string
+		wantErr  bool
+	}{
+		{name: "stablecoin", amount: 12500000, decimals: 6, price: MicrosPerDollar, want: "12500000"},
+		{name: "ether", amount: 1000 * MicrosPerDollar, decimals: 18, price: 2000 * MicrosPerDollar, want: "500000000000000000"},
+		// $1 at $3 is 0.333... tokens
+		{name: "rounds down", amount: MicrosPerDollar, decimals: 2, price: 3 * MicrosPerDollar, want: "33"},
+		{name: "zero price", amount: MicrosPerDollar, decimals: 18, price: 0, wantErr: true},
+		{name: "negative price", amount: MicrosPerDollar, decimals: 18, price: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := usdToUnits(tt.amount, tt.decimals, tt.price)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: usdToUnits error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("%s: usdToUnits = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package ethcashier
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NonceManager allocates nonces for a single sending address on one chain
+// so concurrent transactions never share one. The next nonce is persisted
+// in the settings table and resynced from the chain on startup.
+type NonceManager struct {
+	db      *DB
+	rpc     *RPCClient
+	address string
+
+	mu   sync.Mutex
+	next uint64
+}
+
+// NewNonceManager creates a nonce manager for address, starting from the
+// highest of the persisted next nonce, the chain's pending nonce and any
+// nonce already used by a recorded withdrawal or gas funding
+func NewNonceManager(ctx context.Context, db *DB, rpc *RPCClient, address string) (*NonceManager, error) {
+	m := &NonceManager{db: db, rpc: rpc, address: address}
+
+	stored, err := db.getSetting(m.setting())
+	if err != nil {
+		return nil, err
+	}
+	if stored != "" {
+		if m.next, err = strconv.ParseUint(stored, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid stored nonce %q: %v", stored, err)
+		}
+	}
+
+	pending, err := rpc.PendingNonceAt(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if pending > m.next {
+		m.next = pending
+	}
+
+	var recorded *uint64
+	err = db.QueryRow(`
+    SELECT MAX(nonce) + 1 FROM (
+        SELECT nonce FROM withdrawals WHERE chain = ? AND from_address = ?
+        UNION ALL SELECT nonce FROM gas_fundings WHERE chain = ? AND from_address = ?
+    )`, rpc.Chain(), address, rpc.Chain(), address).Scan(&recorded)
+	if err != nil {
+		return nil, err
+	}
+	if recorded != nil && *recorded > m.next {
+		m.next = *recorded
+	}
+
+	if err := db.setSetting(m.setting(), strconv.FormatUint(m.next, 10)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Address returns the address the manager allocates nonces for
+func (m *NonceManager) Address() string {
+	return m.address
+}
+
+// Reserve calls fn with the next nonce while holding the allocation lock.
+// The nonce is consumed only if fn succeeds, so fn should sign and record
+// the transaction using it; broadcasting can happen after Reserve returns.
+func (m *NonceManager) Reserve(fn func(nonce uint64) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := fn(m.next); err != nil {
+		return err
+	}
+	m.next++
+	if err := m.db.setSetting(m.setting(), strconv.FormatUint(m.next, 10)); err != nil {
+		return fmt.Errorf("failed to persist nonce: %v", err)
+	}
+	return nil
+}
+
+// Gaps returns the nonces between the chain's mined nonce and the next
+// nonce that no pending withdrawal or gas funding holds. Transactions above
+// a gap cannot be mined until it is filled. If the chain is ahead of the
+// manager, as when the address was used elsewhere, the manager skips ahead
+// instead.
+func (m *NonceManager) Gaps(ctx context.Context) ([]uint64, error) {
+	mined, err := m.rpc.NonceAt(ctx, m.address)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if mined > m.next {
+		m.next = mined
+		if err := m.db.setSetting(m.setting(), strconv.FormatUint(m.next, 10)); err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+	}
+	next := m.next
+	m.mu.Unlock()
+
+	rows, err := m.db.Query(`
+    SELECT nonce FROM withdrawals
+    WHERE chain = ? AND from_address = ? AND status IN (?, ?) AND nonce >= ?
+    UNION SELECT nonce FROM gas_fundings
+    WHERE chain = ? AND from_address = ? AND status = ? AND nonce >= ?`,
+		m.rpc.Chain(), m.address, WithdrawalSigned, WithdrawalBroadcast, mined,
+		m.rpc.Chain(), m.address, gasFundingPending, mined)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := make(map[uint64]bool)
+	for rows.Next() {
+		var nonce uint64
+		if err := rows.Scan(&nonce); err != nil {
+			return nil, err
+		}
+		held[nonce] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var gaps []uint64
+	for nonce := mined; nonce < next; nonce++ {
+		if !held[nonce] {
+			gaps = append(gaps, nonce)
+		}
+	}
+	return gaps, nil
+}
+
+func (m *NonceManager) setting() string {
+	return settingNoncePrefix + m.rpc.Chain() + ":" + strings.ToLower(m.address)
+}
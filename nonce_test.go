@@ -0,0 +1,436 @@
+package ethcashier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+const testAdminAddress = "0x00000000000000000000000000000000000000aa"
+
+// fakeNode is a JSON-RPC node serving a chain of blocks, receipts, logs,
+// ETH and token balances and the nonces of a single address
+type fakeNode struct {
+	mu       sync.Mutex
+	chainID  uint64
+	mined    uint64
+	pending  uint64
+	blocks   []*types.Block
+	receipts map[common.Hash]*types.Receipt
+	logs     []types.Log
+	balances map[common.Address]*big.Int
+	// tokenBalances are the balanceOf results of every token contract
+	tokenBalances map[common.Address]*big.Int
+	// calls counts the calls answered, batched or not
+	calls int
+	// batches are the sizes of the batch requests received
+	batches []int
+	// down makes every request fail with an HTTP error
+	down bool
+	// rateLimited makes every call fail with the rate limiting error code
+	rateLimited bool
+}
+
+// newFakeNode returns a node on chain ID 1 with only a genesis block
+func newFakeNode() *fakeNode {
+	n := &fakeNode{
+		chainID:       1,
+		receipts:      make(map[common.Hash]*types.Receipt),
+		balances:      make(map[common.Address]*big.Int),
+		tokenBalances: make(map[common.Address]*big.Int),
+	}
+	n.mine()
+	return n
+}
+
+func (n *fakeNode) set(mined, pending uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.mined, n.pending = mined, pending
+}
+
+// mine appends a block holding txs to the chain
+func (n *fakeNode) mine(txs ...*types.Transaction) *types.Block {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.appendBlock(nil, txs)
+}
+
+// reorg replaces the blocks from number on with as many new empty blocks
+func (n *fakeNode) reorg(number uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	replaced := len(n.blocks) - int(number)
+	n.blocks = n.blocks[:number]
+	for i := 0; i < replaced; i++ {
+		n.appendBlock([]byte("reorg"), nil)
+	}
+}
+
+func (n *fakeNode) appendBlock(extra []byte, txs []*types.Transaction) *types.Block {
+	header := &types.Header{
+		Number:     big.NewInt(int64(len(n.blocks))),
+		Difficulty: new(big.Int),
+		GasLimit:   30000000,
+		Time:       uint64(len(n.blocks)),
+		Extra:      extra,
+	}
+	if len(n.blocks) > 0 {
+		header.ParentHash = n.blocks[len(n.blocks)-1].Hash()
+	}
+	block := types.NewBlock(header, &types.Body{Transactions: txs}, nil, trie.NewStackTrie(nil))
+	n.blocks = append(n.blocks, block)
+	return block
+}
+
+// mineReceipt mines tx in a new block with a receipt of the given status
+func (n *fakeNode) mineReceipt(tx *types.Transaction, status uint64) *types.Receipt {
+	block := n.mine(tx)
+	receipt := &types.Receipt{
+		Status:            status,
+		TxHash:            tx.Hash(),
+		GasUsed:           21000,
+		CumulativeGasUsed: 21000,
+		EffectiveGasPrice: big.NewInt(1),
+		Logs:              []*types.Log{},
+		BlockHash:         block.Hash(),
+		BlockNumber:       block.Number(),
+	}
+	n.mu.Lock()
+	n.receipts[tx.Hash()] = receipt
+	n.mu.Unlock()
+	return receipt
+}
+
+type fakeRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type fakeResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+	Error   *fakeError      `json:"error,omitempty"`
+}
+
+type fakeError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	down := n.down
+	n.mu.Unlock()
+	if down {
+		http.Error(w, "node is down", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 && body[0] == '[' {
+		var reqs []fakeRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.mu.Lock()
+		n.batches = append(n.batches, len(reqs))
+		n.mu.Unlock()
+		resps := make([]fakeResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = n.answer(req)
+		}
+		json.NewEncoder(w).Encode(resps)
+		return
+	}
+	var req fakeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(n.answer(req))
+}
+
+func (n *fakeNode) answer(req fakeRequest) fakeResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls++
+	resp := fakeResponse{JSONRPC: "2.0", ID: req.ID}
+	if n.rateLimited {
+		resp.Error = &fakeError{Code: rateLimitedCode, Message: "rate limited"}
+		return resp
+	}
+
+	param := func(i int) string {
+		var s string
+		if i < len(req.Params) {
+			json.Unmarshal(req.Params[i], &s)
+		}
+		return s
+	}
+	switch req.Method {
+	case "eth_chainId":
+		resp.Result = hexutil.Uint64(n.chainID)
+	case "eth_blockNumber":
+		resp.Result = hexutil.Uint64(len(n.blocks) - 1)
+	case "eth_getBlockByNumber":
+		number := uint64(len(n.blocks) - 1)
+		if tag := param(0); tag != "latest" {
+			number, _ = hexutil.DecodeUint64(tag)
+		}
+		if number < uint64(len(n.blocks)) {
+			resp.Result = blockJSON(n.blocks[number])
+		}
+	case "eth_getTransactionCount":
+		resp.Result = hexutil.Uint64(n.mined)
+		if param(1) == "pending" {
+			resp.Result = hexutil.Uint64(n.pending)
+		}
+	case "eth_getBalance":
+		balance := new(big.Int)
+		if b, ok := n.balances[common.HexToAddress(param(0))]; ok {
+			balance = b
+		}
+		resp.Result = (*hexutil.Big)(balance)
+	case "eth_call":
+		var call struct {
+			Input hexutil.Bytes `json:"input"`
+		}
+		json.Unmarshal(req.Params[0], &call)
+		balance := new(big.Int)
+		if len(call.Input) == 36 {
+			if b, ok := n.tokenBalances[common.BytesToAddress(call.Input[4:])]; ok {
+				balance = b
+			}
+		}
+		resp.Result = hexutil.Bytes(common.BigToHash(balance).Bytes())
+	case "eth_getTransactionReceipt":
+		if receipt, ok := n.receipts[common.HexToHash(param(0))]; ok {
+			resp.Result = receipt
+		}
+	case "eth_getLogs":
+		var filter struct {
+			BlockHash common.Hash `json:"blockHash"`
+		}
+		json.Unmarshal(req.Params[0], &filter)
+		logs := []types.Log{}
+		for _, l := range n.logs {
+			if l.BlockHash == filter.BlockHash {
+				logs = append(logs, l)
+			}
+		}
+		resp.Result = logs
+	default:
+		resp.Error = &fakeError{Code: -32601, Message: "method not found"}
+	}
+	return resp
+}
+
+// blockJSON encodes a block as eth_getBlockByNumber returns it with full
+// transactions
+func blockJSON(b *types.Block) map[string]any {
+	var fields map[string]any
+	raw, _ := json.Marshal(b.Header())
+	json.Unmarshal(raw, &fields)
+	txs := []any{}
+	for _, tx := range b.Transactions() {
+		txs = append(txs, tx)
+	}
+	fields["transactions"] = txs
+	fields["uncles"] = []string{}
+	return fields
+}
+
+// newTestRPC returns a client of the fake nodes on the "ethereum" chain
+func newTestRPC(t *testing.T, nodes ...*fakeNode) *RPCClient {
+	t.Helper()
+	urls := make([]string, len(nodes))
+	for i, node := range nodes {
+		server := httptest.NewServer(node)
+		t.Cleanup(server.Close)
+		urls[i] = server.URL
+	}
+	rpc, err := NewRPCClient(urls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc.chain = "ethereum"
+	rpc.client.expectChainID(big.NewInt(1))
+	return rpc
+}
+
+// holdNonce records a broadcast withdrawal from the admin address at nonce
+func holdNonce(t *testing.T, db *DB, nonce uint64) {
+	t.Helper()
+	_, err := db.Exec(`
+    INSERT INTO withdrawals (user_id, chain, to_address, amount_micros, status, from_address, nonce)
+    VALUES ('u', 'ethereum', ?, 1, ?, ?, ?)`, testRecipient, WithdrawalBroadcast, testAdminAddress, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextNonce returns the nonce the manager would hand out without using it
+func nextNonce(t *testing.T, m *NonceManager) uint64 {
+	t.Helper()
+	var next uint64
+	m.Reserve(func(nonce uint64) error {
+		next = nonce
+		return errors.New("peek")
+	})
+	return next
+}
+
+func TestNewNonceManager(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   string
+		pending  uint64
+		recorded []uint64
+		want     uint64
+	}{
+		{name: "fresh address", want: 0},
+		{name: "pending nonce", pending: 4, want: 4},
+		{name: "stored nonce ahead of chain", stored: "7", pending: 4, want: 7},
+		{name: "recorded transaction ahead", stored: "2", pending: 2, recorded: []uint64{2, 5}, want: 6},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		node := newFakeNode()
+		node.set(0, tt.pending)
+		rpc := newTestRPC(t, node)
+		for _, nonce := range tt.recorded {
+			holdNonce(t, db, nonce)
+		}
+		m := &NonceManager{rpc: rpc, address: testAdminAddress}
+		if tt.stored != "" {
+			if err := db.setSetting(m.setting(), tt.stored); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		m, err := NewNonceManager(context.Background(), db, rpc, testAdminAddress)
+		if err != nil {
+			t.Fatalf("%s: NewNonceManager: %v", tt.name, err)
+		}
+		if got := nextNonce(t, m); got != tt.want {
+			t.Errorf("%s: next nonce = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNonceManagerReserve(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	node := newFakeNode()
+	node.set(3, 3)
+	rpc := newTestRPC(t, node)
+	m, err := NewNonceManager(ctx, db, rpc, testAdminAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		fail    bool
+		want    uint64
+		wantErr bool
+	}{
+		{name: "first", want: 3},
+		{name: "failed signing keeps the nonce", fail: true, want: 4, wantErr: true},
+		{name: "retry reuses it", want: 4},
+		{name: "next", want: 5},
+	}
+	for _, step := range steps {
+		var got uint64
+		err := m.Reserve(func(nonce uint64) error {
+			got = nonce
+			if step.fail {
+				return errors.New("signer unavailable")
+			}
+			return nil
+		})
+		if (err != nil) != step.wantErr {
+			t.Errorf("%s: Reserve error = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+		if got != step.want {
+			t.Errorf("%s: Reserve nonce = %d, want %d", step.name, got, step.want)
+		}
+	}
+
+	// The next nonce survives a restart even if the chain has not seen the
+	// transactions yet
+	m, err = NewNonceManager(ctx, db, rpc, testAdminAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := nextNonce(t, m); got != 6 {
+		t.Errorf("next nonce after restart = %d, want 6", got)
+	}
+}
+
+func TestNonceManagerGaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		reserved int
+		held     []uint64
+		mined    uint64
+		want     []uint64
+		wantNext uint64
+	}{
+		{name: "nothing reserved", mined: 0, wantNext: 0},
+		{name: "all held", reserved: 3, held: []uint64{0, 1, 2}, mined: 0, wantNext: 3},
+		{name: "abandoned nonce", reserved: 3, held: []uint64{0, 2}, mined: 0, want: []uint64{1}, wantNext: 3},
+		{name: "mined nonces are not gaps", reserved: 4, held: []uint64{3}, mined: 2, want: []uint64{2}, wantNext: 4},
+		{name: "chain ahead skips forward", reserved: 2, mined: 5, wantNext: 5},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		db := newTestDB(t)
+		node := newFakeNode()
+		rpc := newTestRPC(t, node)
+		m, err := NewNonceManager(ctx, db, rpc, testAdminAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < tt.reserved; i++ {
+			if err := m.Reserve(func(uint64) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, nonce := range tt.held {
+			holdNonce(t, db, nonce)
+		}
+		node.set(tt.mined, tt.mined)
+
+		gaps, err := m.Gaps(ctx)
+		if err != nil {
+			t.Fatalf("%s: Gaps: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(gaps, tt.want) {
+			t.Errorf("%s: Gaps = %v, want %v", tt.name, gaps, tt.want)
+		}
+		if got := nextNonce(t, m); got != tt.wantNext {
+			t.Errorf("%s: next nonce = %d, want %d", tt.name, got, tt.wantNext)
+		}
+	}
+}
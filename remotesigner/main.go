@@ -0,0 +1,46 @@
+// Command remotesigner is a local stand-in for a web3signer style remote
+// signer. It serves eth_signTransaction for a single key so RemoteSigner can
+// be tested against anvil without running a real signing service.
+//
+// Usage:
+//
+//	REMOTE_SIGNER_PRIV_KEY=<hex key> go run remotesigner/main.go
+//
+// then set ADMIN_REMOTE_SIGNER_URL=http://localhost:9000 and
+// ADMIN_WALLET_ADDRESS to the printed address.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	ethcashier "github.com/gotsteez/eth_cashier"
+)
+
+func main() {
+	privateKey := os.Getenv("REMOTE_SIGNER_PRIV_KEY")
+	if privateKey == "" {
+		log.Fatal("REMOTE_SIGNER_PRIV_KEY is missing from env variables")
+	}
+	key, err := ethcashier.ParseECDSAPrivateKeyFromHex(strings.TrimPrefix(privateKey, "0x"))
+	if err != nil {
+		log.Fatalf("Private key parse error: %v", err)
+	}
+	signer := ethcashier.NewKeySigner(key)
+
+	handler, err := ethcashier.NewRemoteSignerServer(signer)
+	if err != nil {
+		log.Fatalf("Failed to create signer server: %v", err)
+	}
+
+	addr := os.Getenv("REMOTE_SIGNER_ADDR")
+	if addr == "" {
+		addr = ":9000"
+	}
+	log.Printf("signing for %s on %s", signer.Address().Hex(), addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Fatalf("failed to start signer: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package ethcashier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// reorgWindow is how many blocks back CheckDepositReorgs looks for deposits
+// whose block may have been orphaned
+const reorgWindow = 256
+
+// CheckDepositReorgs compares the block of each recent deposit on the
+// client's chain with the canonical chain. A swept deposit is credited at
+// the block its sweep was mined in, so a sweep that is reorged out and then
+// reverts or is dropped is caught here; a watch-only deposit keeps the block
+// it was seen in. A deposit whose block was orphaned is kept if its sweep was
+// mined successfully on the canonical chain, and is then anchored to the
+// sweep's new block. Otherwise its credit is reversed, and a reversed
+// deposit is credited again if its sweep is mined later, however long after
+// its orphaned block that is. Reversing a
+// watch-only deposit also removes it from the address's unswept balance, so
+// the next check credits whatever the address really holds.
+func CheckDepositReorgs(ctx context.Context, db *DB, rpc *RPCClient) error {
+	head, err := rpc.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	var from uint64
+	if head > reorgWindow {
+		from = head - reorgWindow
+	}
+
+	// Deposits recorded before block hashes were tracked are skipped, as are
+	// deposits whose sweep was never credited. A reversed deposit with a
+	// sweep is checked whatever its block, as the sweep may be mined long
+	// after the reorg.
+	deposits, err := db.queryDeposits(depositColumns+`
+    WHERE chain = ? AND block_hash != ''
+        AND ((status = ? AND block_number >= ?) OR (status = ? AND tx_hash != ''))
+    ORDER BY id`,
+		rpc.Chain(), DepositCredited, from, DepositReversed)
+	if err != nil {
+		return err
+	}
+
+	canonical := make(map[uint64]string)
+	var errs []error
+	for i := range deposits {
+		d := &deposits[i]
+		if d.Status == DepositReversed {
+			if err := recreditDeposit(ctx, db, rpc, d); err != nil {
+				errs = append(errs, fmt.Errorf("deposit %d: %v", d.ID, err))
+			}
+			continue
+		}
+
+		hash, ok := canonical[d.BlockNumber]
+		if !ok {
+			header, err := rpc.HeaderByNumber(ctx, d.BlockNumber)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			hash = header.Hash().Hex()
+			canonical[d.BlockNumber] = hash
+		}
+		if hash == d.BlockHash {
+			continue
+		}
+
+		if err := resolveOrphanedDeposit(ctx, db, rpc, d); err != nil {
+			errs = append(errs, fmt.Errorf("deposit %d: %v", d.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveOrphanedDeposit keeps a deposit whose block was orphaned if its
+// sweep is mined on the canonical chain, and reverses it otherwise
+func resolveOrphanedDeposit(ctx context.Context, db *DB, rpc *RPCClient, d *Deposit) error {
+	receipt, err := sweepReceipt(ctx, rpc, d)
+	if err != nil {
+		return err
+	}
+	if receipt != nil {
+		return db.anchorDeposit(d, receipt)
+	}
+	err = db.reverseDeposit(d)
+	if err == ErrInsufficientFunds {
+		return fmt.Errorf("block %d was orphaned but user %s has already spent the deposit, it needs manual review", d.BlockNumber, d.User)
+	}
+	return err
+}
+
+// recreditDeposit credits a reversed deposit again once its sweep is mined
+func recreditDeposit(ctx context.Context, db *DB, rpc *RPCClient, d *Deposit) error {
+	receipt, err := sweepReceipt(ctx, rpc, d)
+	if err != nil || receipt == nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+    UPDATE deposits SET status = ?, block_number = ?, block_hash = ?
+    WHERE id = ? AND status = ?`,
+		DepositCredited, receipt.BlockNumber.Uint64(), receipt.BlockHash.Hex(), d.ID, DepositReversed)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	memo := fmt.Sprintf("deposit %d swept in %s after its block was orphaned", d.ID, d.TxHash)
+	if _, err := postTx(tx, LedgerDeposit, memo, depositPostings(d.treasuryAccount(), d.User, d.Amount)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sweepReceipt returns the receipt of a deposit's sweep if it was mined
+// successfully on the canonical chain, or nil
+func sweepReceipt(ctx context.Context, rpc *RPCClient, d *Deposit) (*types.Receipt, error) {
+	if d.TxHash == "" {
+		return nil, nil
+	}
+	receipt, err := rpc.TransactionReceipt(ctx, d.TxHash)
+	if err != nil || receipt == nil {
+		return nil, err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return nil, nil
+	}
+	return receipt, nil
+}
+
+// anchorDeposit moves a deposit to the block its sweep was mined in
+func (db *DB) anchorDeposit(d *Deposit, receipt *types.Receipt) error {
+	_, err := db.Exec("UPDATE deposits SET block_number = ?, block_hash = ? WHERE id = ?",
+		receipt.BlockNumber.Uint64(), receipt.BlockHash.Hex(), d.ID)
+	return err
+}
+
+// reverseDeposit takes back a deposit's credit exactly once. It fails with
+// ErrInsufficientFunds if the user has already spent it.
+func (db *DB) reverseDeposit(d *Deposit) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE deposits SET status = ? WHERE id = ? AND status = ?",
+		DepositReversed, d.ID, DepositCredited)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	memo := fmt.Sprintf("deposit %d orphaned at block %d", d.ID, d.BlockNumber)
+	_, err = postTx(tx, LedgerDepositReversal, memo, []Posting{
+		{Account: UserAccount(d.User), Amount: d.Amount},
+		{Account: d.treasuryAccount(), Amount: -d.Amount},
+	})
+	if err != nil {
+		return err
+	}
+
+	// A watch-only deposit is no longer known to be held on the address
+	if d.TxHash == "" {
+		amount, err := parseWei(d.AmountWei)
+		if err != nil {
+			return err
+		}
+		unswept, err := getUnsweptWei(tx, d.User, d.Chain)
+		if err != nil {
+			return err
+		}
+		unswept.Sub(unswept, amount)
+		if unswept.Sign() < 0 {
+			unswept = new(big.Int)
+		}
+		if err := setUnsweptWei(tx, d.User, d.Chain, unswept); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
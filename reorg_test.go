@@ -0,0 +1,122 @@
+package ethcashier
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestCheckDepositReorgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		watchOnly bool
+		// orphan reorgs out the deposit's block along with its sweep
+		orphan bool
+		// remine mines the sweep again on the new chain before the first or
+		// the second check
+		remine int
+		// bury mines past the reorg window before the second check
+		bury bool
+		// spend withdraws the deposit before its block is orphaned
+		spend       bool
+		wantStatus  string
+		wantBalance USD
+		wantErr     bool
+	}{
+		{name: "canonical deposit", wantStatus: DepositCredited, wantBalance: 2 * MicrosPerDollar},
+		{name: "sweep mined again on the new chain", orphan: true, remine: 1, wantStatus: DepositCredited, wantBalance: 2 * MicrosPerDollar},
+		{name: "sweep lost in the reorg", orphan: true, wantStatus: DepositReversed},
+		{name: "reversed deposit swept later", orphan: true, remine: 2, wantStatus: DepositCredited, wantBalance: 2 * MicrosPerDollar},
+		{name: "reversed deposit swept after the window", orphan: true, bury: true, remine: 2, wantStatus: DepositCredited, wantBalance: 2 * MicrosPerDollar},
+		{name: "watch-only deposit", watchOnly: true, orphan: true, wantStatus: DepositReversed},
+		{name: "deposit already spent", orphan: true, spend: true, wantStatus: DepositCredited, wantErr: true},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		db := newTestDB(t)
+		node := newFakeNode()
+		rpc := newTestRPC(t, node)
+		user := newTestUser(t, db, "alice")
+		node.mine()
+
+		// 1e15 wei at 2000 USD/ETH is 2 USD
+		amount := big.NewInt(1e15)
+		d, err := newDeposit(rpc.Chain(), user, amount, 2000*MicrosPerDollar, node.mine().Header(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sweepTx := signTestTx(t, testAdminAddress, 0)
+		if tt.watchOnly {
+			if err := db.creditUnswept(new(big.Int), amount, d); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			if err := db.createPendingDeposit(d, sweepTx); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.creditDeposit(d, node.mineReceipt(sweepTx, types.ReceiptStatusSuccessful)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		node.mine()
+		if tt.spend {
+			if _, err := db.CreateWithdrawal(user.ID, rpc.Chain(), assetETH, testRecipient, 2*MicrosPerDollar); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if tt.orphan {
+			deposits, err := db.ListDeposits(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			node.reorg(deposits[0].BlockNumber)
+			delete(node.receipts, sweepTx.Hash())
+		}
+		for check := 1; check <= 2; check++ {
+			if tt.bury && check == 2 {
+				for i := 0; i <= reorgWindow; i++ {
+					node.mine()
+				}
+			}
+			if tt.remine == check {
+				node.mineReceipt(sweepTx, types.ReceiptStatusSuccessful)
+			}
+			err = CheckDepositReorgs(ctx, db, rpc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: check %d: CheckDepositReorgs error = %v, wantErr %v", tt.name, check, err, tt.wantErr)
+			}
+		}
+
+		deposits, err := db.ListDeposits(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := deposits[0]
+		if got.Status != tt.wantStatus {
+			t.Errorf("%s: status = %s, want %s", tt.name, got.Status, tt.wantStatus)
+		}
+		if got.Status == DepositCredited && !tt.spend {
+			if canonical := node.blocks[got.BlockNumber].Hash().Hex(); got.BlockHash != canonical {
+				t.Errorf("%s: deposit is anchored to %s, not the canonical block %s", tt.name, got.BlockHash, canonical)
+			}
+		}
+		if u, _ := db.GetUser(user.ID); !tt.spend && u.Balance != tt.wantBalance {
+			t.Errorf("%s: balance = %s, want %s", tt.name, u.Balance, tt.wantBalance)
+		}
+		if tt.watchOnly {
+			unswept, err := getUnsweptWei(db, user.ID, rpc.Chain())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unswept.Sign() != 0 {
+				t.Errorf("%s: unswept = %s after the reversal, want 0", tt.name, unswept)
+			}
+		}
+		if err := db.VerifyLedger(); err != nil {
+			t.Errorf("%s: VerifyLedger: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package ethcashier
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// A pending withdrawal can be replaced at the same nonce, either by the
+// same transfer with higher fees or by a zero-value transfer to the admin
+// wallet that cancels it. Every replacement is kept as an attempt so the
+// tracker recognizes whichever one is mined.
+
+// Kinds of withdrawal attempts
+const (
+	attemptTransfer = "transfer"
+	attemptCancel   = "cancel"
+)
+
+// replacementBumpPercent is how much nodes require a replacement
+// transaction to raise both fee caps by
+const replacementBumpPercent = 10
+
+// maxSpeedUps is how many times SpeedUpWithdrawals replaces a withdrawal.
+// A withdrawal still stuck after that needs CancelWithdrawal or a look at
+// why it is not being mined.
+const maxSpeedUps = 5
+
+// withdrawalAttempt is a transaction sent at a withdrawal's nonce
+type withdrawalAttempt struct {
+	Kind      string
+	TxHash    string
+	CreatedAt time.Time
+}
+
+func insertWithdrawalAttempt(tx *sql.Tx, withdrawalID int64, kind string, signedTx *types.Transaction) error {
+	_, err := tx.Exec(`
+    INSERT INTO withdrawal_txs (withdrawal_id, kind, tx_hash)
+    VALUES (?, ?, ?)`, withdrawalID, kind, signedTx.Hash().Hex())
+	return err
+}
+
+// addWithdrawalAttempt records a replacement transaction and makes it the
+// one the withdrawal rebroadcasts
+func (db *DB) addWithdrawalAttempt(w *Withdrawal, kind string, signedTx *types.Transaction) error {
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+    UPDATE withdrawals SET tx_hash = ?, raw_tx = ?, updated_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND status IN (?, ?)`,
+		signedTx.Hash().Hex(), hex.EncodeToString(raw), w.ID, WithdrawalSigned, WithdrawalBroadcast)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("withdrawal %d is no longer pending", w.ID)
+	}
+	if err := insertWithdrawalAttempt(tx, w.ID, kind, signedTx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// withdrawalAttempts returns the transactions sent for a withdrawal, oldest
+// first. Withdrawals recorded before attempts were tracked have their single
+// transfer returned.
+func (db *DB) withdrawalAttempts(w *Withdrawal) ([]withdrawalAttempt, error) {
+	rows, err := db.Query(`
+    SELECT kind, tx_hash, created_at FROM withdrawal_txs
+    WHERE withdrawal_id = ? ORDER BY id`, w.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []withdrawalAttempt
+	for rows.Next() {
+		var a withdrawalAttempt
+		if err := rows.Scan(&a.Kind, &a.TxHash, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(attempts) == 0 && w.TxHash != "" {
+		attempts = append(attempts, withdrawalAttempt{Kind: attemptTransfer, TxHash: w.TxHash, CreatedAt: w.UpdatedAt})
+	}
+	return attempts, nil
+}
+
+// findAttemptReceipt returns the receipt of whichever attempt was mined, or
+// nil if none was. A lookup the node cannot answer yet only fails the call
+// if no other attempt was mined.
+func findAttemptReceipt(ctx context.Context, rpc *RPCClient, attempts []withdrawalAttempt) (*types.Receipt, *withdrawalAttempt, error) {
+	var lookupErr error
+	for i := range attempts {
+		receipt, err := rpc.TransactionReceipt(ctx, attempts[i].TxHash)
+		if err != nil {
+			lookupErr = err
+			continue
+		}
+		if receipt != nil {
+			return receipt, &attempts[i], nil
+		}
+	}
+	return nil, nil, lookupErr
+}
+
+// SpeedUpWithdrawals replaces withdrawals on the client's chain from the
+// nonce manager's address whose latest transaction has been pending for
+// longer than timeout with the same transaction at higher fees, up to
+// maxSpeedUps times each. Withdrawals above a nonce gap are left alone,
+// since no fee gets them mined before the gap is filled.
+func SpeedUpWithdrawals(ctx context.Context, db *DB, rpc *RPCClient, signer Signer, nonces *NonceManager, timeout time.Duration) error {
+	withdrawals, err := db.unfinishedWithdrawals(rpc.Chain())
+	if err != nil {
+		return err
+	}
+	gaps, err := nonces.Gaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range withdrawals {
+		w := &withdrawals[i]
+		if w.Status != WithdrawalSigned && w.Status != WithdrawalBroadcast {
+			continue
+		}
+		if !strings.EqualFold(w.From, nonces.Address()) {
+			continue
+		}
+		if len(gaps) > 0 && *w.Nonce > gaps[0] {
+			continue
+		}
+
+		attempts, err := db.withdrawalAttempts(w)
+		if err != nil {
+			return err
+		}
+		if len(attempts) == 0 || len(attempts) > maxSpeedUps || time.Since(attempts[len(attempts)-1].CreatedAt) < timeout {
+			continue
+		}
+
+		latest := attempts[len(attempts)-1]
+		if _, err := replaceWithdrawal(ctx, db, rpc, signer, w, latest.Kind); err != nil {
+			errs = append(errs, fmt.Errorf("withdrawal %d: %v", w.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CancelWithdrawal replaces a pending withdrawal with a zero-value transfer
+// from the admin wallet to itself at the same nonce. If the cancellation is
+// mined the tracker fails and refunds the withdrawal; if the original
+// transfer wins the race it is confirmed as usual. It returns the hash of
+// the cancelling transaction.
+func CancelWithdrawal(ctx context.Context, db *DB, rpc *RPCClient, signer Signer, id int64) (string, error) {
+	w, err := db.GetWithdrawal(id)
+	if err != nil {
+		return "", err
+	}
+	if w == nil {
+		return "", fmt.Errorf("withdrawal %d not found", id)
+	}
+	if w.Status != WithdrawalSigned && w.Status != WithdrawalBroadcast {
+		return "", fmt.Errorf("withdrawal %d is %s, only pending withdrawals can be cancelled", id, w.Status)
+	}
+	if w.Chain != rpc.Chain() {
+		return "", fmt.Errorf("withdrawal %d was sent on %s, not %s", id, w.Chain, rpc.Chain())
+	}
+	if !strings.EqualFold(w.From, signer.Address().Hex()) {
+		return "", fmt.Errorf("withdrawal %d was sent from %s, not %s", id, w.From, signer.Address().Hex())
+	}
+	return replaceWithdrawal(ctx, db, rpc, signer, w, attemptCancel)
+}
+
+// replaceWithdrawal signs and broadcasts a replacement for the withdrawal's
+// latest transaction with bumped fees, returning its hash
+func replaceWithdrawal(ctx context.Context, db *DB, rpc *RPCClient, signer Signer, w *Withdrawal, kind string) (string, error) {
+	// Replacing a nonce that is already used would only waste a signature
+	mined, err := rpc.NonceAt(ctx, w.From)
+	if err != nil {
+		return "", err
+	}
+	if mined > *w.Nonce {
+		return "", fmt.Errorf("nonce %d is already mined", *w.Nonce)
+	}
+
+	raw, err := hex.DecodeString(w.rawTx)
+	if err != nil {
+		return "", fmt.Errorf("invalid raw transaction: %v", err)
+	}
+	latest := new(types.Transaction)
+	if err := latest.UnmarshalBinary(raw); err != nil {
+		return "", fmt.Errorf("failed to decode transaction: %v", err)
+	}
+
+	suggested, err := rpc.SuggestFees(ctx)
+	if err != nil {
+		return "", err
+	}
+	fees := replacementFees(latest, suggested)
+	if max := rpc.fees.MaxFeePerGas; max != 0 && fees.GasFeeCap.Cmp(new(big.Int).SetUint64(max)) > 0 {
+		return "", fmt.Errorf("replacement max fee of %s wei per gas is above the cap of %d", fees.GasFeeCap, max)
+	}
+
+	var signedTx *types.Transaction
+	switch {
+	case kind == attemptCancel:
+		signedTx, err = rpc.SignTransferWithNonce(ctx, signer, signer.Address().Hex(), new(big.Int), *w.Nonce, fees)
+	case w.Asset != assetETH:
+		// A token withdrawal repeats the same call to the token contract
+		signedTx, err = rpc.SignCallWithNonce(ctx, signer, *latest.To(), latest.Data(), *w.Nonce, latest.Gas(), fees)
+	default:
+		signedTx, err = rpc.SignTransferWithNonce(ctx, signer, w.To, latest.Value(), *w.Nonce, fees)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Record the replacement first so it is tracked even if the broadcast
+	// reaches the network but reports an error
+	if err := db.addWithdrawalAttempt(w, kind, signedTx); err != nil {
+		return "", err
+	}
+	if err := rpc.SendSignedTransaction(ctx, signedTx); err != nil {
+		db.setWithdrawalError(w.ID, err.Error())
+		return "", err
+	}
+	if w.Status == WithdrawalSigned {
+		if err := db.setWithdrawalBroadcast(w.ID); err != nil {
+			return "", err
+		}
+	}
+	return signedTx.Hash().Hex(), nil
+}
+
+// replacementFees returns the suggested fees, raised where needed to at
+// least replacementBumpPercent above tx's fees so nodes accept the
+// replacement
+func replacementFees(tx *types.Transaction, suggested *Fees) *Fees {
+	if suggested.GasTipCap == nil {
+		return &Fees{GasFeeCap: bumpFee(tx.GasPrice(), suggested.GasFeeCap)}
+	}
+	fees := &Fees{
+		GasTipCap: bumpFee(tx.GasTipCap(), suggested.GasTipCap),
+		GasFeeCap: bumpFee(tx.GasFeeCap(), suggested.GasFeeCap),
+	}
+	if fees.GasFeeCap.Cmp(fees.GasTipCap) < 0 {
+		fees.GasFeeCap = fees.GasTipCap
+	}
+	return fees
+}
+
+// bumpFee returns suggested, or old raised by replacementBumpPercent and
+// rounded up if that is higher
+func bumpFee(old, suggested *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(old, big.NewInt(100+replacementBumpPercent))
+	bumped.Add(bumped, big.NewInt(99))
+	bumped.Quo(bumped, big.NewInt(100))
+	if suggested.Cmp(bumped) > 0 {
+		return suggested
+	}
+	return bumped
+}
@@ -0,0 +1,91 @@
+package ethcashier
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestBumpFee(t *testing.T) {
+	tests := []struct {
+		name      string
+		old       int64
+		suggested int64
+		want      int64
+	}{
+		{name: "bumped by ten percent", old: 100, suggested: 50, want: 110},
+		{name: "rounds up", old: 101, suggested: 0, want: 112},
+		{name: "exact bump", old: 1000, suggested: 1100, want: 1100},
+		{name: "suggested is higher", old: 100, suggested: 150, want: 150},
+		{name: "zero", old: 0, suggested: 0, want: 0},
+	}
+	for _, tt := range tests {
+		got := bumpFee(big.NewInt(tt.old), big.NewInt(tt.suggested))
+		if got.Cmp(big.NewInt(tt.want)) != 0 {
+			t.Errorf("%s: bumpFee(%d, %d) = %s, want %d", tt.name, tt.old, tt.suggested, got, tt.want)
+		}
+		// Nodes reject a replacement below a 10% bump
+		floor := new(big.Int).Mul(big.NewInt(tt.old), big.NewInt(110))
+		if new(big.Int).Mul(got, big.NewInt(100)).Cmp(floor) < 0 {
+			t.Errorf("%s: bumpFee(%d, %d) = %s is below the 10%% rule", tt.name, tt.old, tt.suggested, got)
+		}
+	}
+}
+
+func TestReplacementFees(t *testing.T) {
+	legacy := types.NewTx(&types.LegacyTx{GasPrice: big.NewInt(1000)})
+	dynamic := types.NewTx(&types.DynamicFeeTx{GasTipCap: big.NewInt(100), GasFeeCap: big.NewInt(1000)})
+
+	tests := []struct {
+		name      string
+		tx        *types.Transaction
+		suggested *Fees
+		wantTip   *big.Int
+		wantCap   *big.Int
+	}{
+		{
+			name:      "legacy bumped",
+			tx:        legacy,
+			suggested: &Fees{GasFeeCap: big.NewInt(900)},
+			wantCap:   big.NewInt(1100),
+		},
+		{
+			name:      "legacy suggested",
+			tx:        legacy,
+			suggested: &Fees{GasFeeCap: big.NewInt(2000)},
+			wantCap:   big.NewInt(2000),
+		},
+		{
+			name:      "dynamic bumped",
+			tx:        dynamic,
+			suggested: &Fees{GasTipCap: big.NewInt(50), GasFeeCap: big.NewInt(500)},
+			wantTip:   big.NewInt(110),
+			wantCap:   big.NewInt(1100),
+		},
+		{
+			name:      "dynamic suggested tip",
+			tx:        dynamic,
+			suggested: &Fees{GasTipCap: big.NewInt(300), GasFeeCap: big.NewInt(500)},
+			wantTip:   big.NewInt(300),
+			wantCap:   big.NewInt(1100),
+		},
+		{
+			name:      "fee cap raised to tip",
+			tx:        dynamic,
+			suggested: &Fees{GasTipCap: big.NewInt(5000), GasFeeCap: big.NewInt(500)},
+			wantTip:   big.NewInt(5000),
+			wantCap:   big.NewInt(5000),
+		},
+	}
+	for _, tt := range tests {
+		fees := replacementFees(tt.tx, tt.suggested)
+		if (fees.GasTipCap == nil) != (tt.wantTip == nil) ||
+			(tt.wantTip != nil && fees.GasTipCap.Cmp(tt.wantTip) != 0) {
+			t.Errorf("%s: tip cap = %v, want %v", tt.name, fees.GasTipCap, tt.wantTip)
+		}
+		if fees.GasFeeCap.Cmp(tt.wantCap) != 0 {
+			t.Errorf("%s: fee cap = %s, want %s", tt.name, fees.GasFeeCap, tt.wantCap)
+		}
+	}
+}
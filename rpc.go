@@ -4,13 +4,18 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
 func ParseECDSAPrivateKeyFromHex(hexString string) (*ecdsa.PrivateKey, error) {
@@ -31,31 +36,177 @@ func ParseECDSAPrivateKeyFromHex(hexString string) (*ecdsa.PrivateKey, error) {
 
 // Client struct to hold the RPC client
 type RPCClient struct {
-	rpcURL string
-	client *ethclient.Client
+	client *endpointPool
+	fees   FeeConfig
+	// chainID is the chain ID verified by VerifyChainID, used for signing
+	chainIDMu sync.Mutex
+	chainID   *big.Int
+	// chain is the name of the chain the client is connected to
+	chain string
 }
 
-// NewRPCClient creates a new instance of Client
-func NewRPCClient(rpcURL string) (*RPCClient, error) {
-	client, err := ethclient.Dial(rpcURL)
+// Fee models
+const (
+	// FeeModelEIP1559 chains are priced by base fee and tip, falling back to
+	// a legacy gas price if the chain has no base fee
+	FeeModelEIP1559 = "eip1559"
+	// FeeModelLegacy chains are always sent legacy gas price transactions
+	FeeModelLegacy = "legacy"
+	// FeeModelArbitrum chains charge for L1 data in L2 gas, so a plain
+	// transfer needs more than 21000 gas and its gas limit is estimated
+	FeeModelArbitrum = "arbitrum"
+	// FeeModelOPStack chains such as Optimism and Base charge an L1 data fee
+	// on top of the L2 gas fee
+	FeeModelOPStack = "op-stack"
+)
+
+// FeeConfig controls the fees offered by dynamic fee transactions
+type FeeConfig struct {
+	// Model is one of the fee models, FeeModelEIP1559 if empty
+	Model string `json:"model"`
+	// BaseFeeMultiplier scales the latest base fee in the max fee per gas,
+	// so a transaction stays includable while the base fee rises. On
+	// op-stack chains it scales the L1 data fee too.
+	BaseFeeMultiplier float64 `json:"baseFeeMultiplier"`
+	// TipMultiplier scales the node's suggested priority fee
+	TipMultiplier float64 `json:"tipMultiplier"`
+	// MaxFeePerGas is the highest max fee per gas, in wei, that a stuck
+	// withdrawal is bumped to. Zero leaves replacements uncapped.
+	MaxFeePerGas uint64 `json:"maxFeePerGas"`
+}
+
+// DefaultFeeConfig allows the base fee to double before a transaction
+// becomes unincludable, and tips what the node suggests
+var DefaultFeeConfig = FeeConfig{Model: FeeModelEIP1559, BaseFeeMultiplier: 2, TipMultiplier: 1}
+
+// Fees are the fee parameters of a new transaction. GasTipCap is nil on
+// chains without EIP-1559, in which case GasFeeCap is the legacy gas price.
+type Fees struct {
+	GasTipCap *big.Int
+	GasFeeCap *big.Int
+	// BaseFee is the latest base fee the fees were suggested at, if known
+	BaseFee *big.Int
+}
+
+// MaxCost returns the most a transaction with the given gas limit can pay
+// in fees
+func (f *Fees) MaxCost(gas uint64) *big.Int {
+	return new(big.Int).Mul(f.GasFeeCap, new(big.Int).SetUint64(gas))
+}
+
+// Exact returns fees whose tip cap equals the fee cap, so the transaction
+// pays exactly MaxCost whatever the base fee is when it is mined. The fee
+// cap is lowered to the latest base fee plus the tip, so no more than the
+// suggested tip is paid on top of the base fee. Sweeps use this to leave
+// nothing behind on the sending address.
+func (f *Fees) Exact() *Fees {
+	if f.GasTipCap == nil {
+		return f
+	}
+	feeCap := f.GasFeeCap
+	if f.BaseFee != nil {
+		feeCap = new(big.Int).Add(f.BaseFee, f.GasTipCap)
+	}
+	return &Fees{GasTipCap: feeCap, GasFeeCap: feeCap, BaseFee: f.BaseFee}
+}
+
+// DefaultRPCTimeout is how long a call to one RPC endpoint may take before
+// it fails over to the next endpoint
+const DefaultRPCTimeout = 10 * time.Second
+
+// balanceBatchSize is how many balances GetBalances reads per JSON-RPC batch,
+// kept within the batch limits of the common providers
+const balanceBatchSize = 100
+
+// transferGasLimit is the gas limit of a plain ETH transfer
+const transferGasLimit = 21000
+
+// NewRPCClient creates a new instance of Client. Given several URLs of the
+// same chain, it fails over between them.
+func NewRPCClient(rpcURLs ...string) (*RPCClient, error) {
+	pool, err := dialEndpoints(rpcURLs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to RPC: %v", err)
 	}
 
 	return &RPCClient{
-		rpcURL: rpcURL,
-		client: client,
+		client: pool,
+		fees:   DefaultFeeConfig,
 	}, nil
 }
 
+// ParseFeeConfig parses fee multipliers such as "1.5" and the replacement
+// max fee per gas in wei, using the default for any that are empty
+func ParseFeeConfig(baseFeeMultiplier, tipMultiplier, maxFeePerGas string) (FeeConfig, error) {
+	config := DefaultFeeConfig
+	var err error
+	if baseFeeMultiplier != "" {
+		if config.BaseFeeMultiplier, err = strconv.ParseFloat(baseFeeMultiplier, 64); err != nil {
+			return config, fmt.Errorf("invalid base fee multiplier %q", baseFeeMultiplier)
+		}
+	}
+	if tipMultiplier != "" {
+		if config.TipMultiplier, err = strconv.ParseFloat(tipMultiplier, 64); err != nil {
+			return config, fmt.Errorf("invalid tip multiplier %q", tipMultiplier)
+		}
+	}
+	if maxFeePerGas != "" {
+		if config.MaxFeePerGas, err = strconv.ParseUint(maxFeePerGas, 10, 64); err != nil {
+			return config, fmt.Errorf("invalid max fee per gas %q", maxFeePerGas)
+		}
+	}
+	return config, nil
+}
+
+// SetFeeConfig changes the fee model and multipliers used for new
+// transactions
+func (c *RPCClient) SetFeeConfig(config FeeConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if config.Model == "" {
+		config.Model = FeeModelEIP1559
+	}
+	c.fees = config
+	return nil
+}
+
+// validate checks the fee model is known and the multipliers are sane
+func (config FeeConfig) validate() error {
+	switch config.Model {
+	case "", FeeModelEIP1559, FeeModelLegacy, FeeModelArbitrum, FeeModelOPStack:
+	default:
+		return fmt.Errorf("unknown fee model %q", config.Model)
+	}
+	if config.BaseFeeMultiplier < 1 {
+		return fmt.Errorf("base fee multiplier must be at least 1")
+	}
+	if config.TipMultiplier <= 0 {
+		return fmt.Errorf("tip multiplier must be positive")
+	}
+	return nil
+}
+
+// SetTimeout sets how long a call to one RPC endpoint may take before it
+// fails over to the next endpoint. Zero leaves calls to the caller's
+// context alone.
+func (c *RPCClient) SetTimeout(timeout time.Duration) {
+	c.client.timeout = timeout
+}
+
+// Chain returns the name of the chain the client is connected to
+func (c *RPCClient) Chain() string {
+	return c.chain
+}
+
 // GetBalance returns the balance of the given address
-func (c *RPCClient) GetBalance(address string) (*big.Int, error) {
+func (c *RPCClient) GetBalance(ctx context.Context, address string) (*big.Int, error) {
 	if !common.IsHexAddress(address) {
 		return nil, fmt.Errorf("invalid address format")
 	}
 
 	account := common.HexToAddress(address)
-	balance, err := c.client.BalanceAt(context.Background(), account, nil)
+	balance, err := c.client.BalanceAt(ctx, account, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get balance: %v", err)
 	}
@@ -63,76 +214,455 @@ func (c *RPCClient) GetBalance(address string) (*big.Int, error) {
 	return balance, nil
 }
 
-func (c *RPCClient) Send(from *ecdsa.PrivateKey, to string, amount *big.Int) error {
-	ctx := context.Background()
+// GetBalances returns the latest balances of addresses in order, reading
+// them in JSON-RPC batches rather than one request per address
+func (c *RPCClient) GetBalances(ctx context.Context, addresses []string) ([]*big.Int, error) {
+	accounts := make([]common.Address, len(addresses))
+	for i, address := range addresses {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("invalid address format: %s", address)
+		}
+		accounts[i] = common.HexToAddress(address)
+	}
 
-	// Get the public address from the private key
-	publicKey := from.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("error casting public key to ECDSA")
+	balances := make([]*big.Int, 0, len(accounts))
+	for start := 0; start < len(accounts); start += balanceBatchSize {
+		end := min(start+balanceBatchSize, len(accounts))
+		batch, err := c.client.BatchBalanceAt(ctx, accounts[start:end], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get balances: %v", err)
+		}
+		balances = append(balances, batch...)
 	}
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
+	return balances, nil
+}
 
-	// Validate recipient address
-	if !common.IsHexAddress(to) {
-		return fmt.Errorf("invalid recipient address format")
+// BlockNumber returns the number of the latest block
+func (c *RPCClient) BlockNumber(ctx context.Context) (uint64, error) {
+	number, err := c.client.BlockNumber(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get block number: %v", err)
 	}
-	toAddress := common.HexToAddress(to)
+	return number, nil
+}
 
-	// Get the sender's nonce
-	nonce, err := c.client.PendingNonceAt(ctx, fromAddress)
+// BlockByNumber returns the block with the given number and its transactions
+func (c *RPCClient) BlockByNumber(ctx context.Context, number uint64) (*types.Block, error) {
+	block, err := c.client.BlockByNumber(ctx, new(big.Int).SetUint64(number))
 	if err != nil {
-		return fmt.Errorf("failed to get nonce: %v", err)
+		return nil, fmt.Errorf("failed to get block %d: %v", number, err)
 	}
+	return block, nil
+}
 
-	// Get current gas price
-	gasPrice, err := c.client.SuggestGasPrice(ctx)
+// HeaderByNumber returns the header of the block with the given number
+func (c *RPCClient) HeaderByNumber(ctx context.Context, number uint64) (*types.Header, error) {
+	header, err := c.client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
 	if err != nil {
-		return fmt.Errorf("failed to get gas price: %v", err)
+		return nil, fmt.Errorf("failed to get block header %d: %v", number, err)
 	}
+	return header, nil
+}
 
-	// Create transaction data
-	tx := types.NewTransaction(
-		nonce,
-		toAddress,
-		amount,
-		21000, // Standard gas limit for ETH transfers
-		gasPrice,
-		nil, // No data for simple transfers
-	)
+// BalanceAtHash returns the balance of the given address as of a block.
+// Reading by hash rather than number fails instead of silently reading
+// another block if the block has been reorged out.
+func (c *RPCClient) BalanceAtHash(ctx context.Context, address string, blockHash common.Hash) (*big.Int, error) {
+	if !common.IsHexAddress(address) {
+		return nil, fmt.Errorf("invalid address format")
+	}
+
+	account := common.HexToAddress(address)
+	balance, err := c.client.BalanceAtHash(ctx, account, blockHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance: %v", err)
+	}
+
+	return balance, nil
+}
+
+// Send transfers amount wei to the given address, signing with from, and
+// returns the signed transaction with its hash, nonce and fee parameters.
+// Fees are suggested by SuggestFees when fees is nil.
+func (c *RPCClient) Send(ctx context.Context, from Signer, to string, amount *big.Int, fees *Fees) (*types.Transaction, error) {
+	signedTx, err := c.SignTransfer(ctx, from, to, amount, fees)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SendSignedTransaction(ctx, signedTx); err != nil {
+		return nil, err
+	}
+	return signedTx, nil
+}
+
+// SignTransfer builds and signs a transfer of amount wei to the given
+// address at the sender's pending nonce without broadcasting it. Fees are
+// suggested by SuggestFees when fees is nil.
+func (c *RPCClient) SignTransfer(ctx context.Context, from Signer, to string, amount *big.Int, fees *Fees) (*types.Transaction, error) {
+	// Get the sender's nonce
+	nonce, err := c.client.PendingNonceAt(ctx, from.Address())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nonce: %v", err)
+	}
+	return c.SignTransferWithNonce(ctx, from, to, amount, nonce, fees)
+}
 
-	// Get the chain ID
-	chainID, err := c.client.NetworkID(ctx)
+// SignTransferWithNonce is SignTransfer with a nonce chosen by the caller,
+// such as one allocated by a NonceManager
+func (c *RPCClient) SignTransferWithNonce(ctx context.Context, from Signer, to string, amount *big.Int, nonce uint64, fees *Fees) (*types.Transaction, error) {
+	var err error
+	if fees == nil {
+		if fees, err = c.SuggestFees(ctx); err != nil {
+			return nil, err
+		}
+	}
+	gas, cost, err := c.TransferCost(ctx, from.Address().Hex(), to, amount, fees)
 	if err != nil {
-		return fmt.Errorf("failed to get chain id: %v", err)
+		return nil, err
 	}
 
-	// Calculate total cost (amount + gas)
-	gasCost := new(big.Int).Mul(gasPrice, big.NewInt(21000))
-	totalCost := new(big.Int).Add(amount, gasCost)
+	// Calculate the most the transfer can cost (amount + max fees)
+	totalCost := new(big.Int).Add(amount, cost)
 
 	// Check if sender has sufficient balance
-	balance, err := c.GetBalance(fromAddress.Hex())
+	balance, err := c.GetBalance(ctx, from.Address().Hex())
 	if err != nil {
-		return fmt.Errorf("failed to get sender balance: %v", err)
+		return nil, fmt.Errorf("failed to get sender balance: %v", err)
 	}
 
 	if balance.Cmp(totalCost) < 0 {
-		return fmt.Errorf("insufficient funds for transfer: need %v but got %v", totalCost, balance)
+		return nil, fmt.Errorf("insufficient funds for transfer: need %v but got %v", totalCost, balance)
+	}
+
+	return c.SignTransferWithGas(ctx, from, to, amount, nonce, gas, fees)
+}
+
+// SignTransferWithGas signs a transfer with a gas limit chosen by the
+// caller, such as one returned by TransferCost, without checking the
+// sender's balance
+func (c *RPCClient) SignTransferWithGas(ctx context.Context, from Signer, to string, amount *big.Int, nonce, gas uint64, fees *Fees) (*types.Transaction, error) {
+	// Validate recipient address
+	if !common.IsHexAddress(to) {
+		return nil, fmt.Errorf("invalid recipient address format")
+	}
+
+	chainID, err := c.ChainID(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	tx := NewTransfer(chainID, nonce, common.HexToAddress(to), amount, gas, fees)
+
 	// Sign the transaction
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), from)
+	signedTx, err := from.SignTx(ctx, tx, chainID)
 	if err != nil {
-		return fmt.Errorf("failed to sign transaction: %v", err)
+		return nil, fmt.Errorf("failed to sign transaction: %v", err)
+	}
+
+	return signedTx, nil
+}
+
+// NonceAt returns the number of transactions mined from the given address
+func (c *RPCClient) NonceAt(ctx context.Context, address string) (uint64, error) {
+	if !common.IsHexAddress(address) {
+		return 0, fmt.Errorf("invalid address format")
 	}
 
-	// Send the transaction
-	err = c.client.SendTransaction(ctx, signedTx)
+	nonce, err := c.client.NonceAt(ctx, common.HexToAddress(address), nil)
 	if err != nil {
-		return fmt.Errorf("failed to send transaction: %v", err)
+		return 0, fmt.Errorf("failed to get nonce: %v", err)
+	}
+	return nonce, nil
+}
+
+// NonceAtHash returns the number of transactions mined from the given
+// address as of a block
+func (c *RPCClient) NonceAtHash(ctx context.Context, address string, blockHash common.Hash) (uint64, error) {
+	if !common.IsHexAddress(address) {
+		return 0, fmt.Errorf("invalid address format")
 	}
 
+	nonce, err := c.client.NonceAtHash(ctx, common.HexToAddress(address), blockHash)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get nonce: %v", err)
+	}
+	return nonce, nil
+}
+
+// PendingNonceAt returns the next nonce for the given address, including
+// transactions still in the mempool
+func (c *RPCClient) PendingNonceAt(ctx context.Context, address string) (uint64, error) {
+	if !common.IsHexAddress(address) {
+		return 0, fmt.Errorf("invalid address format")
+	}
+
+	nonce, err := c.client.PendingNonceAt(ctx, common.HexToAddress(address))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pending nonce: %v", err)
+	}
+	return nonce, nil
+}
+
+// SuggestFees returns fees for a new transaction: a tip from the node's
+// suggested priority fee and a max fee covering the latest base fee scaled
+// by the fee config. Chains without a base fee or with the legacy fee model
+// get a legacy gas price.
+func (c *RPCClient) SuggestFees(ctx context.Context) (*Fees, error) {
+	header, err := c.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest header: %v", err)
+	}
+	if header.BaseFee == nil || c.fees.Model == FeeModelLegacy {
+		gasPrice, err := c.SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Fees{GasFeeCap: gasPrice}, nil
+	}
+
+	tip, err := c.client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gas tip cap: %v", err)
+	}
+	tip = mulFloat(tip, c.fees.TipMultiplier)
+	feeCap := new(big.Int).Add(mulFloat(header.BaseFee, c.fees.BaseFeeMultiplier), tip)
+	return &Fees{GasTipCap: tip, GasFeeCap: feeCap, BaseFee: header.BaseFee}, nil
+}
+
+// TransferCost returns the gas limit of a transfer of amount wei between
+// the given addresses and the most it can cost at the given fees, including
+// the L1 data fee on op-stack chains
+func (c *RPCClient) TransferCost(ctx context.Context, from, to string, amount *big.Int, fees *Fees) (uint64, *big.Int, error) {
+	if !common.IsHexAddress(from) || !common.IsHexAddress(to) {
+		return 0, nil, fmt.Errorf("invalid address format")
+	}
+	toAddress := common.HexToAddress(to)
+
+	gas := uint64(transferGasLimit)
+	if c.fees.Model == FeeModelArbitrum {
+		estimated, err := c.client.EstimateGas(ctx, ethereum.CallMsg{
+			From:  common.HexToAddress(from),
+			To:    &toAddress,
+			Value: amount,
+		})
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to estimate transfer gas: %v", err)
+		}
+		gas = estimated
+	}
+
+	cost, err := c.TxCost(ctx, NewTransfer(nil, 0, toAddress, amount, gas, fees))
+	if err != nil {
+		return 0, nil, err
+	}
+	return gas, cost, nil
+}
+
+// TxCost returns the most an unsigned transaction can cost in fees: its gas
+// limit at its fee cap, plus the L1 data fee on op-stack chains
+func (c *RPCClient) TxCost(ctx context.Context, tx *types.Transaction) (*big.Int, error) {
+	cost := new(big.Int).Mul(tx.GasFeeCap(), new(big.Int).SetUint64(tx.Gas()))
+	if c.fees.Model != FeeModelOPStack {
+		return cost, nil
+	}
+	l1Fee, err := c.l1DataFee(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	return cost.Add(cost, l1Fee), nil
+}
+
+// gasPriceOracle is the op-stack predeploy that prices the L1 data fee
+var gasPriceOracle = common.HexToAddress("0x420000000000000000000000000000000000000F")
+
+// getL1FeeSelector is the selector of the oracle's getL1Fee(bytes)
+var getL1FeeSelector = crypto.Keccak256([]byte("getL1Fee(bytes)"))[:4]
+
+// l1DataFee returns the L1 data fee an op-stack chain charges for tx,
+// scaled by the base fee multiplier so it still covers the fee if the L1
+// base fee rises before tx is included
+func (c *RPCClient) l1DataFee(ctx context.Context, tx *types.Transaction) (*big.Int, error) {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	// ABI encoding of a single bytes argument: offset, length, padded data
+	data := append([]byte{}, getL1FeeSelector...)
+	data = append(data, common.LeftPadBytes(big.NewInt(32).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(big.NewInt(int64(len(raw))).Bytes(), 32)...)
+	data = append(data, common.RightPadBytes(raw, (len(raw)+31)/32*32)...)
+
+	result, err := c.client.CallContract(ctx, ethereum.CallMsg{To: &gasPriceOracle, Data: data}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get L1 data fee: %v", err)
+	}
+	if len(result) < 32 {
+		return nil, fmt.Errorf("invalid L1 data fee response")
+	}
+	return mulFloat(new(big.Int).SetBytes(result[:32]), c.fees.BaseFeeMultiplier), nil
+}
+
+// NewTransfer builds an unsigned transfer, as a dynamic fee transaction
+// unless fees has no tip cap
+func NewTransfer(chainID *big.Int, nonce uint64, to common.Address, amount *big.Int, gas uint64, fees *Fees) *types.Transaction {
+	return newTx(chainID, nonce, to, amount, gas, fees, nil)
+}
+
+// newTx builds an unsigned transaction calling to with data, as a dynamic
+// fee transaction unless fees has no tip cap
+func newTx(chainID *big.Int, nonce uint64, to common.Address, value *big.Int, gas uint64, fees *Fees, data []byte) *types.Transaction {
+	if fees.GasTipCap == nil {
+		return types.NewTransaction(nonce, to, value, gas, fees.GasFeeCap, data)
+	}
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		GasTipCap: fees.GasTipCap,
+		GasFeeCap: fees.GasFeeCap,
+		Gas:       gas,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+	})
+}
+
+// mulFloat returns x scaled by m, rounded down
+func mulFloat(x *big.Int, m float64) *big.Int {
+	product, _ := new(big.Float).Mul(new(big.Float).SetInt(x), big.NewFloat(m)).Int(nil)
+	return product
+}
+
+// SuggestGasPrice returns the node's suggested legacy gas price
+func (c *RPCClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	gasPrice, err := c.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gas price: %v", err)
+	}
+	return gasPrice, nil
+}
+
+// VerifyChainID asks every endpoint for its chain ID and fails unless the
+// endpoints that answer all report expected. The verified chain ID is used
+// to sign every transaction from then on, and endpoints reporting another
+// one are never used.
+func (c *RPCClient) VerifyChainID(ctx context.Context, expected uint64) error {
+	if expected == 0 {
+		return fmt.Errorf("no chain id configured")
+	}
+	chainID, err := c.client.verifyChainID(ctx, new(big.Int).SetUint64(expected))
+	if err != nil {
+		return fmt.Errorf("failed to verify chain id: %v", err)
+	}
+
+	c.chainIDMu.Lock()
+	defer c.chainIDMu.Unlock()
+	c.chainID = chainID
+	return nil
+}
+
+// ChainID returns the chain ID used for EIP-155 signing. It fails until
+// VerifyChainID has succeeded, so nothing is ever signed for an unverified
+// chain.
+func (c *RPCClient) ChainID(ctx context.Context) (*big.Int, error) {
+	c.chainIDMu.Lock()
+	defer c.chainIDMu.Unlock()
+	if c.chainID == nil {
+		return nil, fmt.Errorf("chain id has not been verified")
+	}
+	return c.chainID, nil
+}
+
+// TransactionReceipt returns the receipt of a mined transaction, or nil if
+// the transaction has not been mined yet
+func (c *RPCClient) TransactionReceipt(ctx context.Context, hash string) (*types.Receipt, error) {
+	receipt, err := c.client.TransactionReceipt(ctx, common.HexToHash(hash))
+	if errors.Is(err, ethereum.NotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get receipt: %v", err)
+	}
+	return receipt, nil
+}
+
+// NonceAndReceipts returns the number of transactions mined from address
+// and the receipts of hashes, nil for those not mined yet and for empty
+// hashes. Both are read from the same endpoint, so a transaction counted by
+// the nonce always has its receipt.
+func (c *RPCClient) NonceAndReceipts(ctx context.Context, address string, hashes []string) (uint64, []*types.Receipt, error) {
+	if !common.IsHexAddress(address) {
+		return 0, nil, fmt.Errorf("invalid address format")
+	}
+	txHashes := make([]common.Hash, len(hashes))
+	for i, hash := range hashes {
+		if hash != "" {
+			txHashes[i] = common.HexToHash(hash)
+		}
+	}
+
+	nonce, receipts, err := c.client.NonceAndReceipts(ctx, common.HexToAddress(address), txHashes)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get nonce and receipts: %v", err)
+	}
+	return nonce, receipts, nil
+}
+
+// ErrTxReverted is returned by WaitForReceipt when the transaction was
+// mined but failed
+var ErrTxReverted = errors.New("transaction reverted")
+
+// receiptPollInterval is how often WaitForReceipt checks for a receipt
+const receiptPollInterval = 2 * time.Second
+
+// WaitForReceipt polls until the transaction is mined with at least the
+// given number of confirmations, counting its own block as the first, and
+// returns its receipt. A reverted transaction returns its receipt with
+// ErrTxReverted. If ctx ends first its error is returned.
+func (c *RPCClient) WaitForReceipt(ctx context.Context, hash string, confirmations uint64) (*types.Receipt, error) {
+	ticker := time.NewTicker(receiptPollInterval)
+	defer ticker.Stop()
+
+	for {
+		receipt, err := c.client.TransactionReceipt(ctx, common.HexToHash(hash))
+		switch {
+		case err == nil:
+			head, err := c.client.BlockNumber(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get block number: %v", err)
+			}
+			if head+1 >= receipt.BlockNumber.Uint64()+confirmations {
+				if receipt.Status != types.ReceiptStatusSuccessful {
+					return receipt, ErrTxReverted
+				}
+				return receipt, nil
+			}
+		case errors.Is(err, ethereum.NotFound), isIndexingError(err):
+			// Not mined yet
+		case ctx.Err() != nil:
+			return nil, fmt.Errorf("timed out waiting for receipt of %s: %v", hash, ctx.Err())
+		default:
+			return nil, fmt.Errorf("failed to get receipt: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for receipt of %s: %v", hash, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// isIndexingError reports whether a receipt lookup failed only because the
+// node has not finished indexing transactions
+func isIndexingError(err error) bool {
+	return strings.Contains(err.Error(), "transaction indexing is in progress")
+}
+
+// SendSignedTransaction broadcasts an already signed transaction
+func (c *RPCClient) SendSignedTransaction(ctx context.Context, tx *types.Transaction) error {
+	if err := c.client.SendTransaction(ctx, tx); err != nil {
+		return fmt.Errorf("failed to send transaction: %v", err)
+	}
 	return nil
 }
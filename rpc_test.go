@@ -0,0 +1,93 @@
+package ethcashier
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestGetBalances(t *testing.T) {
+	tests := []struct {
+		name        string
+		addresses   int
+		wantBatches []int
+	}{
+		{name: "none", addresses: 0},
+		{name: "one", addresses: 1, wantBatches: []int{1}},
+		{name: "full batch", addresses: balanceBatchSize, wantBatches: []int{balanceBatchSize}},
+		{name: "one over", addresses: balanceBatchSize + 1, wantBatches: []int{balanceBatchSize, 1}},
+		{name: "several", addresses: 2*balanceBatchSize + 50, wantBatches: []int{balanceBatchSize, balanceBatchSize, 50}},
+	}
+	for _, tt := range tests {
+		node := newFakeNode()
+		rpc := newTestRPC(t, node)
+		addresses := make([]string, tt.addresses)
+		for i := range addresses {
+			address := common.BigToAddress(big.NewInt(int64(i + 1)))
+			addresses[i] = address.Hex()
+			// Every other address holds its index in wei
+			if i%2 == 0 {
+				node.balances[address] = big.NewInt(int64(i))
+			}
+		}
+
+		balances, err := rpc.GetBalances(context.Background(), addresses)
+		if err != nil {
+			t.Fatalf("%s: GetBalances: %v", tt.name, err)
+		}
+		if len(balances) != len(addresses) {
+			t.Fatalf("%s: got %d balances for %d addresses", tt.name, len(balances), len(addresses))
+		}
+		for i, balance := range balances {
+			want := new(big.Int)
+			if i%2 == 0 {
+				want.SetInt64(int64(i))
+			}
+			if balance.Cmp(want) != 0 {
+				t.Errorf("%s: balance %d = %s, want %s", tt.name, i, balance, want)
+			}
+		}
+		if !reflect.DeepEqual(node.batches, tt.wantBatches) {
+			t.Errorf("%s: batches %v, want %v", tt.name, node.batches, tt.wantBatches)
+		}
+	}
+}
+
+func TestGetBalancesRejectsInvalidAddress(t *testing.T) {
+	rpc := newTestRPC(t, newFakeNode())
+	addresses := []string{common.BigToAddress(big.NewInt(1)).Hex(), "not an address"}
+	if _, err := rpc.GetBalances(context.Background(), addresses); err == nil {
+		t.Error("GetBalances accepted an invalid address")
+	}
+}
+
+func TestFeesExact(t *testing.T) {
+	tests := []struct {
+		name                   string
+		fees                   Fees
+		wantTipCap, wantFeeCap *big.Int
+	}{
+		{name: "legacy", fees: Fees{GasFeeCap: big.NewInt(200)}, wantFeeCap: big.NewInt(200)},
+		{
+			name:       "base fee plus tip",
+			fees:       Fees{GasTipCap: big.NewInt(10), GasFeeCap: big.NewInt(210), BaseFee: big.NewInt(100)},
+			wantTipCap: big.NewInt(110),
+			wantFeeCap: big.NewInt(110),
+		},
+		{
+			name:       "unknown base fee",
+			fees:       Fees{GasTipCap: big.NewInt(10), GasFeeCap: big.NewInt(210)},
+			wantTipCap: big.NewInt(210),
+			wantFeeCap: big.NewInt(210),
+		},
+	}
+	for _, tt := range tests {
+		got := tt.fees.Exact()
+		if !reflect.DeepEqual(got.GasTipCap, tt.wantTipCap) || got.GasFeeCap.Cmp(tt.wantFeeCap) != 0 {
+			t.Errorf("%s: Exact = tip %v, fee cap %v, want %v, %v", tt.name, got.GasTipCap, got.GasFeeCap, tt.wantTipCap, tt.wantFeeCap)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package ethcashier
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"golang.org/x/term"
+)
+
+// Signer signs transactions on behalf of a single address, so the key can
+// live in memory, in a keystore file, or in a separate signing service
+type Signer interface {
+	// Address returns the address transactions are sent from
+	Address() common.Address
+	// SignTx returns tx signed for the given chain
+	SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+// KeySigner signs with a private key held in memory
+type KeySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+// NewKeySigner creates a signer for an in-memory private key
+func NewKeySigner(key *ecdsa.PrivateKey) *KeySigner {
+	return &KeySigner{key: key}
+}
+
+// Address returns the address of the private key
+func (s *KeySigner) Address() common.Address {
+	return crypto.PubkeyToAddress(s.key.PublicKey)
+}
+
+// SignTx signs tx with the private key. The London signer handles both
+// legacy and dynamic fee transactions.
+func (s *KeySigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.NewLondonSigner(chainID), s.key)
+}
+
+// NewKeystoreSigner decrypts a geth keystore v3 JSON file with passphrase
+// and returns a signer for the key it holds
+func NewKeystoreSigner(path, passphrase string) (*KeySigner, error) {
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore: %v", err)
+	}
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt keystore: %v", err)
+	}
+	return NewKeySigner(key.PrivateKey), nil
+}
+
+// KeystoreAddress returns the address recorded in a keystore v3 file
+// without decrypting it
+func KeystoreAddress(path string) (string, error) {
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read keystore: %v", err)
+	}
+	var key struct {
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal(keyJSON, &key); err != nil {
+		return "", fmt.Errorf("failed to parse keystore: %v", err)
+	}
+	if !common.IsHexAddress(key.Address) {
+		return "", fmt.Errorf("keystore has no valid address")
+	}
+	return common.HexToAddress(key.Address).Hex(), nil
+}
+
+// AdminSignerFromEnv loads the admin wallet signer. The wallet is signed
+// for remotely when ADMIN_REMOTE_SIGNER_URL is set, otherwise it is loaded
+// from the keystore at ADMIN_KEYSTORE_PATH. The plaintext key in
+// ADMIN_WALLET_PRIV_KEY is only meant for local development.
+func AdminSignerFromEnv() (Signer, error) {
+	if remoteSignerURL := os.Getenv("ADMIN_REMOTE_SIGNER_URL"); remoteSignerURL != "" {
+		signer, err := NewRemoteSigner(remoteSignerURL, os.Getenv("ADMIN_WALLET_ADDRESS"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize remote signer: %v", err)
+		}
+		return signer, nil
+	}
+	if keystorePath := os.Getenv("ADMIN_KEYSTORE_PATH"); keystorePath != "" {
+		passphrase, err := ReadPassphrase(os.Getenv("ADMIN_KEYSTORE_PASSWORD_FILE"), "Admin keystore passphrase: ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin keystore passphrase: %v", err)
+		}
+		signer, err := NewKeystoreSigner(keystorePath, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load admin keystore: %v", err)
+		}
+		return signer, nil
+	}
+	adminPrivateKey := os.Getenv("ADMIN_WALLET_PRIV_KEY")
+	if adminPrivateKey == "" {
+		return nil, fmt.Errorf("no admin private key found in env")
+	}
+	adminWallet, err := ParseECDSAPrivateKeyFromHex(adminPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("admin wallet parse error: %v", err)
+	}
+	return NewKeySigner(adminWallet), nil
+}
+
+// ReadPassphrase reads a keystore passphrase from file, or prompts for it on
+// the terminal when file is empty so it never has to be stored in the env
+func ReadPassphrase(file, prompt string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase file: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("no passphrase file given and stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	return string(passphrase), nil
+}
+
+// RemoteSigner signs through a web3signer style JSON-RPC endpoint using
+// eth_signTransaction, so the key never enters this process
+type RemoteSigner struct {
+	address common.Address
+	client  *rpc.Client
+}
+
+// NewRemoteSigner creates a signer for address backed by the JSON-RPC
+// signing service at url
+func NewRemoteSigner(url string, address string) (*RemoteSigner, error) {
+	if !common.IsHexAddress(address) {
+		return nil, fmt.Errorf("invalid signer address format")
+	}
+	client, err := rpc.DialHTTP(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to remote signer: %v", err)
+	}
+	return &RemoteSigner{
+		address: common.HexToAddress(address),
+		client:  client,
+	}, nil
+}
+
+// Address returns the address the remote signer signs for
+func (s *RemoteSigner) Address() common.Address {
+	return s.address
+}
+
+// SignTx asks the remote signer to sign tx and checks the result is the
+// same transaction signed by the expected address with replay protection
+func (s *RemoteSigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	var result json.RawMessage
+	err := s.client.CallContext(ctx, &result, "eth_signTransaction", newSignTxArgs(s.address, tx, chainID))
+	if err != nil {
+		return nil, fmt.Errorf("remote signer failed: %v", err)
+	}
+
+	// web3signer returns the raw transaction, geth returns {raw, tx}
+	var raw hexutil.Bytes
+	if err := json.Unmarshal(result, &raw); err != nil {
+		var wrapped struct {
+			Raw hexutil.Bytes `json:"raw"`
+		}
+		if err := json.Unmarshal(result, &wrapped); err != nil {
+			return nil, fmt.Errorf("unexpected remote signer response: %s", result)
+		}
+		raw = wrapped.Raw
+	}
+
+	signedTx := new(types.Transaction)
+	if err := signedTx.UnmarshalBinary(raw); err != nil {
+		return nil, fmt.Errorf("failed to decode signed transaction: %v", err)
+	}
+	// An unprotected signature could be replayed on every other chain
+	if !signedTx.Protected() {
+		return nil, fmt.Errorf("remote signer returned a transaction without replay protection")
+	}
+	signer := types.LatestSignerForChainID(chainID)
+	sender, err := types.Sender(signer, signedTx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature from remote signer: %v", err)
+	}
+	if sender != s.address || signer.Hash(signedTx) != signer.Hash(tx) {
+		return nil, fmt.Errorf("remote signer returned a different transaction")
+	}
+	return signedTx, nil
+}
+
+// signTxArgs are the eth_signTransaction parameters
+type signTxArgs struct {
+	From                 common.Address  `json:"from"`
+	To                   *common.Address `json:"to,omitempty"`
+	Gas                  hexutil.Uint64  `json:"gas"`
+	GasPrice             *hexutil.Big    `json:"gasPrice,omitempty"`
+	MaxFeePerGas         *hexutil.Big    `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas *hexutil.Big    `json:"maxPriorityFeePerGas,omitempty"`
+	Value                *hexutil.Big    `json:"value"`
+	Nonce                hexutil.Uint64  `json:"nonce"`
+	Data                 hexutil.Bytes   `json:"data"`
+	ChainID              *hexutil.Big    `json:"chainId"`
+}
+
+func newSignTxArgs(from common.Address, tx *types.Transaction, chainID *big.Int) signTxArgs {
+	args := signTxArgs{
+		From:    from,
+		To:      tx.To(),
+		Gas:     hexutil.Uint64(tx.Gas()),
+		Value:   (*hexutil.Big)(tx.Value()),
+		Nonce:   hexutil.Uint64(tx.Nonce()),
+		Data:    tx.Data(),
+		ChainID: (*hexutil.Big)(chainID),
+	}
+	if tx.Type() == types.DynamicFeeTxType {
+		args.MaxFeePerGas = (*hexutil.Big)(tx.GasFeeCap())
+		args.MaxPriorityFeePerGas = (*hexutil.Big)(tx.GasTipCap())
+	} else {
+		args.GasPrice = (*hexutil.Big)(tx.GasPrice())
+	}
+	return args
+}
+
+// toTransaction rebuilds the unsigned transaction described by args
+func (args signTxArgs) toTransaction() (*types.Transaction, error) {
+	if args.Value == nil || args.ChainID == nil {
+		return nil, fmt.Errorf("value and chainId are required")
+	}
+	if args.MaxFeePerGas != nil && args.MaxPriorityFeePerGas != nil {
+		return types.NewTx(&types.DynamicFeeTx{
+			ChainID:   args.ChainID.ToInt(),
+			Nonce:     uint64(args.Nonce),
+			GasTipCap: args.MaxPriorityFeePerGas.ToInt(),
+			GasFeeCap: args.MaxFeePerGas.ToInt(),
+			Gas:       uint64(args.Gas),
+			To:        args.To,
+			Value:     args.Value.ToInt(),
+			Data:      args.Data,
+		}), nil
+	}
+	if args.GasPrice == nil {
+		return nil, fmt.Errorf("gasPrice or maxFeePerGas and maxPriorityFeePerGas are required")
+	}
+	return types.NewTx(&types.LegacyTx{
+		Nonce:    uint64(args.Nonce),
+		GasPrice: args.GasPrice.ToInt(),
+		Gas:      uint64(args.Gas),
+		To:       args.To,
+		Value:    args.Value.ToInt(),
+		Data:     args.Data,
+	}), nil
+}
+
+// signerService implements eth_signTransaction for NewRemoteSignerServer
+type signerService struct {
+	signer Signer
+}
+
+// Accounts returns the address the server signs for
+func (s *signerService) Accounts() []common.Address {
+	return []common.Address{s.signer.Address()}
+}
+
+// SignTransaction signs the transaction and returns it RLP encoded
+func (s *signerService) SignTransaction(ctx context.Context, args signTxArgs) (hexutil.Bytes, error) {
+	if args.From != s.signer.Address() {
+		return nil, fmt.Errorf("unknown account %s", args.From.Hex())
+	}
+	tx, err := args.toTransaction()
+	if err != nil {
+		return nil, err
+	}
+	signedTx, err := s.signer.SignTx(ctx, tx, args.ChainID.ToInt())
+	if err != nil {
+		return nil, err
+	}
+	return signedTx.MarshalBinary()
+}
+
+// NewRemoteSignerServer returns a minimal JSON-RPC signing service for
+// signer. It stands in for web3signer when testing RemoteSigner locally.
+func NewRemoteSignerServer(signer Signer) (http.Handler, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &signerService{signer: signer}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
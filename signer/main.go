@@ -0,0 +1,92 @@
+// Command signer is the offline signer for watch-only deployments. It holds
+// the wallet mnemonic, signs sweep transactions exported by the admin tool,
+// and never needs network access.
+//
+// Usage:
+//
+//	go run signer/main.go xpub                 print the account xpub for WALLET_XPUB
+//	go run signer/main.go sign sweeps.json     sign exported sweeps, writing them to stdout
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	ethcashier "github.com/gotsteez/eth_cashier"
+	"golang.org/x/term"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal("usage: signer xpub | signer sign <sweeps.json>")
+	}
+
+	hd, err := loadWallet()
+	if err != nil {
+		log.Fatalf("Failed to load HD wallet: %v", err)
+	}
+
+	switch os.Args[1] {
+	case "xpub":
+		xpub, err := hd.AccountXPub()
+		if err != nil {
+			log.Fatalf("Failed to get xpub: %v", err)
+		}
+		fmt.Println(xpub)
+
+	case "sign":
+		if len(os.Args) < 3 {
+			log.Fatal("usage: signer sign <sweeps.json>")
+		}
+		data, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to read sweeps: %v", err)
+		}
+		var sweeps []ethcashier.SweepTx
+		if err := json.Unmarshal(data, &sweeps); err != nil {
+			log.Fatalf("Failed to parse sweeps: %v", err)
+		}
+
+		signed, err := ethcashier.SignSweeps(hd, sweeps)
+		if err != nil {
+			log.Fatalf("Failed to sign sweeps: %v", err)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(signed); err != nil {
+			log.Fatalf("Failed to write signed sweeps: %v", err)
+		}
+		log.Printf("signed %d sweeps", len(signed))
+
+	default:
+		log.Fatalf("unknown command %q", os.Args[1])
+	}
+}
+
+// loadWallet reads the mnemonic from WALLET_MNEMONIC, or prompts for it so it
+// does not have to be stored on the signer machine. On a terminal the
+// mnemonic is read without echoing it.
+func loadWallet() (*ethcashier.HDWallet, error) {
+	mnemonic := os.Getenv("WALLET_MNEMONIC")
+	if mnemonic == "" {
+		var line string
+		if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+			fmt.Fprint(os.Stderr, "Mnemonic: ")
+			input, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read mnemonic: %v", err)
+			}
+			line = string(input)
+		} else {
+			var err error
+			if line, err = bufio.NewReader(os.Stdin).ReadString('\n'); err != nil && line == "" {
+				return nil, fmt.Errorf("failed to read mnemonic: %v", err)
+			}
+		}
+		mnemonic = strings.TrimSpace(line)
+	}
+	return ethcashier.NewHDWalletFromMnemonic(mnemonic, os.Getenv("WALLET_MNEMONIC_PASSPHRASE"))
+}
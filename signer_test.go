@@ -0,0 +1,102 @@
+package ethcashier
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// badSigner claims the address of one key but signs whatever sign returns
+type badSigner struct {
+	address common.Address
+	sign    func(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+func (s *badSigner) Address() common.Address {
+	return s.address
+}
+
+func (s *badSigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return s.sign(tx, chainID)
+}
+
+func TestRemoteSignerSignTx(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	chainID := big.NewInt(1)
+
+	signWith := func(key *ecdsa.PrivateKey, signer types.Signer, change func(tx *types.Transaction) *types.Transaction) Signer {
+		return &badSigner{address: address, sign: func(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+			return types.SignTx(change(tx), signer, key)
+		}}
+	}
+	same := func(tx *types.Transaction) *types.Transaction { return tx }
+	recipient := common.HexToAddress(testRecipient)
+	legacy := types.NewTx(&types.LegacyTx{Nonce: 3, GasPrice: big.NewInt(2), Gas: 21000, To: &recipient, Value: big.NewInt(1)})
+	dynamic := types.NewTx(&types.DynamicFeeTx{ChainID: chainID, Nonce: 3, GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(2), Gas: 21000, To: &recipient, Value: big.NewInt(1)})
+
+	tests := []struct {
+		name    string
+		signer  Signer
+		tx      *types.Transaction
+		wantErr string
+	}{
+		{name: "dynamic fee", signer: NewKeySigner(key), tx: dynamic},
+		{name: "legacy", signer: NewKeySigner(key), tx: legacy},
+		{name: "wrong sender", signer: signWith(other, types.LatestSignerForChainID(chainID), same), tx: dynamic, wantErr: "different transaction"},
+		{
+			name: "different transaction",
+			signer: signWith(key, types.LatestSignerForChainID(chainID), func(tx *types.Transaction) *types.Transaction {
+				return types.NewTx(&types.DynamicFeeTx{ChainID: chainID, Nonce: tx.Nonce(), GasTipCap: tx.GasTipCap(), GasFeeCap: tx.GasFeeCap(), Gas: tx.Gas(), To: tx.To(), Value: big.NewInt(1000)})
+			}),
+			tx:      dynamic,
+			wantErr: "different transaction",
+		},
+		{name: "unprotected legacy", signer: signWith(key, types.HomesteadSigner{}, same), tx: legacy, wantErr: "replay protection"},
+	}
+	for _, tt := range tests {
+		handler, err := NewRemoteSignerServer(tt.signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(handler)
+		remote, err := NewRemoteSigner(server.URL, address.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signedTx, err := remote.SignTx(context.Background(), tt.tx, chainID)
+		server.Close()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: SignTx error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: SignTx: %v", tt.name, err)
+			continue
+		}
+		signer := types.LatestSignerForChainID(chainID)
+		if sender, err := types.Sender(signer, signedTx); err != nil || sender != address {
+			t.Errorf("%s: signed by %s, %v, want %s", tt.name, sender.Hex(), err, address.Hex())
+		}
+		if signer.Hash(signedTx) != signer.Hash(tt.tx) || !signedTx.Protected() {
+			t.Errorf("%s: signed a different transaction", tt.name)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package ethcashier
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Watch-only deployments credit deposits without sweeping them. The credited
+// wei still held on each deposit address is tracked per chain in the
+// unswept_balances table, and moved to the admin wallet by sweep
+// transactions that are exported unsigned, signed by an offline signer
+// holding the mnemonic, and broadcast back through BroadcastSweeps.
+
+// SweepTx is an unsigned transaction moving credited funds from a deposit
+// address to the admin wallet
+type SweepTx struct {
+	ID              int64  `json:"id"`
+	User            string `json:"user"`
+	DerivationIndex uint32 `json:"derivationIndex"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Nonce           uint64 `json:"nonce"`
+	Value           string `json:"value"` // wei
+	Gas             uint64 `json:"gas"`   // gas limit
+	// GasPrice is set for legacy transactions, MaxFeePerGas and
+	// MaxPriorityFeePerGas for dynamic fee transactions, all in wei
+	GasPrice             string `json:"gasPrice,omitempty"`
+	MaxFeePerGas         string `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas string `json:"maxPriorityFeePerGas,omitempty"`
+	ChainID              string `json:"chainId"`
+}
+
+// SignedSweep is a sweep transaction signed by the offline signer
+type SignedSweep struct {
+	ID    int64  `json:"id"`
+	RawTx string `json:"rawTx"` // hex encoded signed transaction
+}
+
+// sweepRecord is a row of the sweeps table
+type sweepRecord struct {
+	ID       int64
+	UserID   string
+	Chain    string
+	From     string
+	To       string
+	Nonce    uint64
+	Amount   *big.Int
+	GasPrice *big.Int // max fee per gas for dynamic fee sweeps
+	TipCap   *big.Int // nil for legacy sweeps
+	TxHash   string
+}
+
+// ExportSweeps builds an unsigned sweep transaction to the given address for
+// every HD derived deposit address holding credited funds on the client's
+// chain. Sweeps that were exported but never broadcast are replaced; sweeps
+// already broadcast are left alone until they settle.
+func ExportSweeps(ctx context.Context, db *DB, rpc *RPCClient, to string) ([]SweepTx, error) {
+	if !common.IsHexAddress(to) {
+		return nil, fmt.Errorf("invalid sweep destination address")
+	}
+
+	fees, err := rpc.SuggestFees(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chainID, err := rpc.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Pay exactly the max fee so the sweep empties the address
+	fees = fees.Exact()
+
+	users, err := db.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	var sweeps []SweepTx
+	for _, user := range users {
+		if user.Wallet.DerivationIndex == nil {
+			continue
+		}
+
+		pending, err := db.getUnsettledSweeps(user.ID, rpc.Chain())
+		if err != nil {
+			return nil, err
+		}
+		broadcast := false
+		for _, s := range pending {
+			if s.TxHash != "" {
+				broadcast = true
+			}
+		}
+		if broadcast {
+			continue
+		}
+
+		unswept, err := getUnsweptWei(db, user.ID, rpc.Chain())
+		if err != nil {
+			return nil, err
+		}
+		gas, fee, err := rpc.TransferCost(ctx, user.Wallet.PublicKey, to, unswept, fees)
+		if err != nil {
+			return nil, err
+		}
+		amount := new(big.Int).Sub(unswept, fee)
+		if amount.Sign() <= 0 {
+			continue
+		}
+
+		nonce, err := rpc.PendingNonceAt(ctx, user.Wallet.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		record := &sweepRecord{
+			UserID:   user.ID,
+			Chain:    rpc.Chain(),
+			From:     user.Wallet.PublicKey,
+			To:       to,
+			Nonce:    nonce,
+			Amount:   amount,
+			GasPrice: fees.GasFeeCap,
+			TipCap:   fees.GasTipCap,
+		}
+		if err := db.replaceUnbroadcastSweeps(record); err != nil {
+			return nil, fmt.Errorf("failed to record sweep for user %s: %v", user.ID, err)
+		}
+
+		sweep := SweepTx{
+			ID:              record.ID,
+			User:            user.ID,
+			DerivationIndex: *user.Wallet.DerivationIndex,
+			From:            record.From,
+			To:              record.To,
+			Nonce:           record.Nonce,
+			Value:           record.Amount.String(),
+			Gas:             gas,
+			ChainID:         chainID.String(),
+		}
+		if record.TipCap == nil {
+			sweep.GasPrice = record.GasPrice.String()
+		} else {
+			sweep.MaxFeePerGas = record.GasPrice.String()
+			sweep.MaxPriorityFeePerGas = record.TipCap.String()
+		}
+		sweeps = append(sweeps, sweep)
+	}
+	return sweeps, nil
+}
+
+// SignSweeps signs exported sweep transactions with keys derived from the HD
+// wallet. It is meant to run in an offline signer process.
+func SignSweeps(hd *HDWallet, sweeps []SweepTx) ([]SignedSweep, error) {
+	signed := make([]SignedSweep, 0, len(sweeps))
+	for _, s := range sweeps {
+		privateKey, err := hd.PrivateKey(s.DerivationIndex)
+		if err != nil {
+			return nil, err
+		}
+		address, err := hd.Address(s.DerivationIndex)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(address, s.From) {
+			return nil, fmt.Errorf("sweep %d: index %d derives %s, not %s", s.ID, s.DerivationIndex, address, s.From)
+		}
+		if !common.IsHexAddress(s.To) {
+			return nil, fmt.Errorf("sweep %d: invalid recipient address", s.ID)
+		}
+
+		value, ok := new(big.Int).SetString(s.Value, 10)
+		if !ok {
+			return nil, fmt.Errorf("sweep %d: invalid value %q", s.ID, s.Value)
+		}
+		fees, err := s.fees()
+		if err != nil {
+			return nil, err
+		}
+		chainID, ok := new(big.Int).SetString(s.ChainID, 10)
+		if !ok {
+			return nil, fmt.Errorf("sweep %d: invalid chain id %q", s.ID, s.ChainID)
+		}
+
+		tx := NewTransfer(chainID, s.Nonce, common.HexToAddress(s.To), value, s.Gas, fees)
+		signedTx, err := NewKeySigner(privateKey).SignTx(context.Background(), tx, chainID)
+		if err != nil {
+			return nil, fmt.Errorf("sweep %d: failed to sign transaction: %v", s.ID, err)
+		}
+		raw, err := signedTx.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("sweep %d: failed to encode transaction: %v", s.ID, err)
+		}
+
+		signed = append(signed, SignedSweep{ID: s.ID, RawTx: hex.EncodeToString(raw)})
+	}
+	return signed, nil
+}
+
+// fees returns the fee parameters of an exported sweep
+func (s SweepTx) fees() (*Fees, error) {
+	if s.MaxFeePerGas == "" {
+		gasPrice, ok := new(big.Int).SetString(s.GasPrice, 10)
+		if !ok {
+			return nil, fmt.Errorf("sweep %d: invalid gas price %q", s.ID, s.GasPrice)
+		}
+		return &Fees{GasFeeCap: gasPrice}, nil
+	}
+
+	feeCap, ok := new(big.Int).SetString(s.MaxFeePerGas, 10)
+	if !ok {
+		return nil, fmt.Errorf("sweep %d: invalid max fee %q", s.ID, s.MaxFeePerGas)
+	}
+	tipCap, ok := new(big.Int).SetString(s.MaxPriorityFeePerGas, 10)
+	if !ok {
+		return nil, fmt.Errorf("sweep %d: invalid priority fee %q", s.ID, s.MaxPriorityFeePerGas)
+	}
+	return &Fees{GasTipCap: tipCap, GasFeeCap: feeCap}, nil
+}
+
+// BroadcastSweeps checks each signed sweep against the exported record and
+// broadcasts it, recording the transaction hash so it can be settled
+func BroadcastSweeps(ctx context.Context, db *DB, rpc *RPCClient, signed []SignedSweep) error {
+	for _, s := range signed {
+		record, err := db.getSweep(s.ID)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return fmt.Errorf("sweep %d not found", s.ID)
+		}
+		if record.Chain != rpc.Chain() {
+			return fmt.Errorf("sweep %d was exported for %s, not %s", s.ID, record.Chain, rpc.Chain())
+		}
+
+		raw, err := hex.DecodeString(strings.TrimPrefix(s.RawTx, "0x"))
+		if err != nil {
+			return fmt.Errorf("sweep %d: invalid raw transaction: %v", s.ID, err)
+		}
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(raw); err != nil {
+			return fmt.Errorf("sweep %d: failed to decode transaction: %v", s.ID, err)
+		}
+
+		// Make sure the signer did not change what we exported
+		from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+		if err != nil {
+			return fmt.Errorf("sweep %d: invalid signature: %v", s.ID, err)
+		}
+		if from != common.HexToAddress(record.From) ||
+			tx.To() == nil || *tx.To() != common.HexToAddress(record.To) ||
+			tx.Nonce() != record.Nonce ||
+			tx.Value().Cmp(record.Amount) != 0 ||
+			tx.GasFeeCap().Cmp(record.GasPrice) > 0 {
+			return fmt.Errorf("sweep %d: signed transaction does not match exported sweep", s.ID)
+		}
+
+		if err := rpc.SendSignedTransaction(ctx, tx); err != nil {
+			return fmt.Errorf("sweep %d: %v", s.ID, err)
+		}
+		if err := db.setSweepTxHash(s.ID, tx.Hash().Hex()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settleSweeps deducts mined sweeps from the user's unswept balance on the
+// client's chain. A sweep whose nonce was used without its transaction being
+// mined is discarded.
+func settleSweeps(ctx context.Context, db *DB, rpc *RPCClient, user *User) error {
+	pending, err := db.getUnsettledSweeps(user.ID, rpc.Chain())
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	// The receipts come from the endpoint reporting the nonce, so a sweep
+	// below the nonce without a receipt was really not mined
+	hashes := make([]string, len(pending))
+	for i, s := range pending {
+		hashes[i] = s.TxHash
+	}
+	nonce, receipts, err := rpc.NonceAndReceipts(ctx, user.Wallet.PublicKey, hashes)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range pending {
+		if s.Nonce >= nonce {
+			// Not mined yet
+			continue
+		}
+
+		receipt := receipts[i]
+		if receipt == nil {
+			if err := db.discardSweep(s.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// The fee is paid even if the transfer reverted
+		spent := new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), receipt.EffectiveGasPrice)
+		if receipt.Status == types.ReceiptStatusSuccessful {
+			spent.Add(spent, s.Amount)
+		}
+		if err := db.settleSweep(&s, spent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getUnsweptWei returns the credited wei held on the user's deposit
+// address on chain
+func getUnsweptWei(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, userID, chain string) (*big.Int, error) {
+	var stored string
+	err := q.QueryRow("SELECT unswept_wei FROM unswept_balances WHERE user_id = ? AND chain = ?",
+		userID, chain).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return new(big.Int), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseWei(stored)
+}
+
+func setUnsweptWei(tx *sql.Tx, userID, chain string, unswept *big.Int) error {
+	_, err := tx.Exec(`
+    INSERT INTO unswept_balances (user_id, chain, unswept_wei) VALUES (?, ?, ?)
+    ON CONFLICT(user_id, chain) DO UPDATE SET unswept_wei = excluded.unswept_wei`,
+		userID, chain, unswept.String())
+	return err
+}
+
+// creditUnswept credits the deposit and records newUnswept as the credited
+// amount held on the user's deposit address on the deposit's chain. It fails
+// if the unswept amount changed since it was read so a deposit cannot be
+// credited twice.
+func (db *DB) creditUnswept(oldUnswept, newUnswept *big.Int, d *Deposit) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	unswept, err := getUnsweptWei(tx, d.User, d.Chain)
+	if err != nil {
+		return err
+	}
+	if unswept.Cmp(oldUnswept) != 0 {
+		return fmt.Errorf("deposit was credited concurrently")
+	}
+	if err := setUnsweptWei(tx, d.User, d.Chain, newUnswept); err != nil {
+		return err
+	}
+
+	if err := createDepositTx(tx, d); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) getUnsettledSweeps(userID, chain string) ([]sweepRecord, error) {
+	rows, err := db.Query(`
+    SELECT id, user_id, chain, from_address, to_address, nonce, amount_wei, gas_price_wei, gas_tip_cap_wei, tx_hash
+    FROM sweeps WHERE user_id = ? AND chain = ? AND settled = 0
+    ORDER BY nonce`, userID, chain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sweeps []sweepRecord
+	for rows.Next() {
+		s, err := scanSweep(rows)
+		if err != nil {
+			return nil, err
+		}
+		sweeps = append(sweeps, *s)
+	}
+	return sweeps, rows.Err()
+}
+
+func (db *DB) getSweep(id int64) (*sweepRecord, error) {
+	row := db.QueryRow(`
+    SELECT id, user_id, chain, from_address, to_address, nonce, amount_wei, gas_price_wei, gas_tip_cap_wei, tx_hash
+    FROM sweeps WHERE id = ?`, id)
+	s, err := scanSweep(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+func scanSweep(row interface{ Scan(...any) error }) (*sweepRecord, error) {
+	var s sweepRecord
+	var amount, gasPrice, tipCap string
+	err := row.Scan(&s.ID, &s.UserID, &s.Chain, &s.From, &s.To, &s.Nonce, &amount, &gasPrice, &tipCap, &s.TxHash)
+	if err != nil {
+		return nil, err
+	}
+	if s.Amount, err = parseWei(amount); err != nil {
+		return nil, err
+	}
+	if s.GasPrice, err = parseWei(gasPrice); err != nil {
+		return nil, err
+	}
+	if tipCap != "" {
+		if s.TipCap, err = parseWei(tipCap); err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// replaceUnbroadcastSweeps discards the user's exported but unbroadcast
+// sweeps on s's chain and records s in their place, setting s.ID
+func (db *DB) replaceUnbroadcastSweeps(s *sweepRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM sweeps WHERE user_id = ? AND chain = ? AND settled = 0 AND tx_hash = ''", s.UserID, s.Chain)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+    INSERT INTO sweeps (user_id, chain, from_address, to_address, nonce, amount_wei, gas_price_wei, gas_tip_cap_wei)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.UserID, s.Chain, s.From, s.To, s.Nonce, s.Amount.String(), s.GasPrice.String(), tipCapString(s.TipCap))
+	if err != nil {
+		return err
+	}
+	if s.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) setSweepTxHash(id int64, txHash string) error {
+	_, err := db.Exec("UPDATE sweeps SET tx_hash = ? WHERE id = ?", txHash, id)
+	return err
+}
+
+func (db *DB) discardSweep(id int64) error {
+	_, err := db.Exec("DELETE FROM sweeps WHERE id = ? AND settled = 0", id)
+	return err
+}
+
+// settleSweep marks a sweep as mined and deducts spent from the user's
+// unswept balance on the sweep's chain
+func (db *DB) settleSweep(s *sweepRecord, spent *big.Int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE sweeps SET settled = 1 WHERE id = ? AND settled = 0", s.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		// Already settled
+		return err
+	}
+
+	unswept, err := getUnsweptWei(tx, s.UserID, s.Chain)
+	if err != nil {
+		return err
+	}
+	unswept.Sub(unswept, spent)
+	if unswept.Sign() < 0 {
+		unswept.SetInt64(0)
+	}
+	if err := setUnsweptWei(tx, s.UserID, s.Chain, unswept); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tipCapString stores a tip cap, with legacy sweeps stored as empty
+func tipCapString(tipCap *big.Int) string {
+	if tipCap == nil {
+		return ""
+	}
+	return tipCap.String()
+}
+
+// parseWei parses a wei amount stored as a decimal string
+func parseWei(s string) (*big.Int, error) {
+	wei, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid wei amount %q", s)
+	}
+	return wei, nil
+}
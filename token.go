@@ -0,0 +1,243 @@
+package ethcashier
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// assetETH is the asset of native ETH deposits
+const assetETH = "ETH"
+
+// ERC-20 selectors and the Transfer event topic
+var (
+	balanceOfSelector  = crypto.Keccak256([]byte("balanceOf(address)"))[:4]
+	transferSelector   = crypto.Keccak256([]byte("transfer(address,uint256)"))[:4]
+	transferEventTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+)
+
+// Token is an ERC-20 token accepted for deposits
+type Token struct {
+	Symbol   string
+	Address  common.Address
+	Decimals uint8
+	// Pegged tokens are credited at 1 USD per token instead of their
+	// market price
+	Pegged bool
+	// MinDeposit is the smallest balance in base units that is swept and
+	// credited, so dust is not worth the gas it costs to sweep. Nil accepts
+	// any balance.
+	MinDeposit *big.Int
+}
+
+// ParseTokens parses a comma separated list of tokens such as
+// "USDC:0xA0b8...:6:peg:min=1000000,LINK:0x5149...:18". Each token is its
+// symbol, contract address and decimals, optionally followed by "peg" for
+// stablecoins credited 1:1 with USD and "min=" with the smallest deposit in
+// base units.
+func ParseTokens(s string) ([]Token, error) {
+	var tokens []Token
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 5 {
+			return nil, fmt.Errorf("invalid token %q, expected SYMBOL:ADDRESS:DECIMALS[:peg][:min=UNITS]", entry)
+		}
+
+		symbol := strings.ToUpper(parts[0])
+		if symbol == "" || symbol == assetETH {
+			return nil, fmt.Errorf("invalid token symbol %q", parts[0])
+		}
+		if seen[symbol] {
+			return nil, fmt.Errorf("token %s is listed twice", symbol)
+		}
+		seen[symbol] = true
+		if !common.IsHexAddress(parts[1]) {
+			return nil, fmt.Errorf("invalid address for token %s", symbol)
+		}
+		decimals, err := strconv.ParseUint(parts[2], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decimals for token %s: %v", symbol, err)
+		}
+		token := Token{Symbol: symbol, Address: common.HexToAddress(parts[1]), Decimals: uint8(decimals)}
+		for _, option := range parts[3:] {
+			switch {
+			case option == "peg" && !token.Pegged:
+				token.Pegged = true
+			case strings.HasPrefix(option, "min=") && token.MinDeposit == nil:
+				minDeposit, ok := new(big.Int).SetString(strings.TrimPrefix(option, "min="), 10)
+				if !ok || minDeposit.Sign() < 0 {
+					return nil, fmt.Errorf("invalid minimum deposit %q for token %s", option, symbol)
+				}
+				token.MinDeposit = minDeposit
+			default:
+				return nil, fmt.Errorf("invalid option %q for token %s", option, symbol)
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// TokenTreasury returns the ledger account holding the cashier's balance of
+// a token
+func TokenTreasury(symbol string) string {
+	return AccountTreasury + ":" + symbol
+}
+
+// assetTreasury returns the ledger account holding the cashier's balance of
+// ETH or of a token
+func assetTreasury(asset string) string {
+	if asset == assetETH {
+		return AccountTreasury
+	}
+	return TokenTreasury(asset)
+}
+
+// TokenBalance returns the token balance of the given address as of the
+// latest block
+func (c *RPCClient) TokenBalance(ctx context.Context, token *Token, address string) (*big.Int, error) {
+	return c.tokenBalance(ctx, token, address, func(msg ethereum.CallMsg) ([]byte, error) {
+		return c.client.CallContract(ctx, msg, nil)
+	})
+}
+
+// TokenBalanceAtHash returns the token balance of the given address as of a
+// block
+func (c *RPCClient) TokenBalanceAtHash(ctx context.Context, token *Token, address string, blockHash common.Hash) (*big.Int, error) {
+	return c.tokenBalance(ctx, token, address, func(msg ethereum.CallMsg) ([]byte, error) {
+		return c.client.CallContractAtHash(ctx, msg, blockHash)
+	})
+}
+
+func (c *RPCClient) tokenBalance(ctx context.Context, token *Token, address string, call func(ethereum.CallMsg) ([]byte, error)) (*big.Int, error) {
+	if !common.IsHexAddress(address) {
+		return nil, fmt.Errorf("invalid address format")
+	}
+
+	data := append(append([]byte{}, balanceOfSelector...), common.LeftPadBytes(common.HexToAddress(address).Bytes(), 32)...)
+	result, err := call(ethereum.CallMsg{To: &token.Address, Data: data})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s balance: %v", token.Symbol, err)
+	}
+	if len(result) < 32 {
+		return nil, fmt.Errorf("invalid %s balance response", token.Symbol)
+	}
+	return new(big.Int).SetBytes(result[:32]), nil
+}
+
+// TokenTransfers returns the Transfer events of the given tokens in a block
+func (c *RPCClient) TokenTransfers(ctx context.Context, tokens []Token, blockHash common.Hash) ([]types.Log, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	addresses := make([]common.Address, len(tokens))
+	for i, t := range tokens {
+		addresses[i] = t.Address
+	}
+
+	logs, err := c.client.FilterLogs(ctx, ethereum.FilterQuery{
+		BlockHash: &blockHash,
+		Addresses: addresses,
+		Topics:    [][]common.Hash{{transferEventTopic}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token transfers: %v", err)
+	}
+	return logs, nil
+}
+
+// transferRecipient returns the address an ERC-20 Transfer event paid, or
+// false if the log is not a Transfer event
+func transferRecipient(l types.Log) (common.Address, bool) {
+	if len(l.Topics) != 3 || l.Topics[0] != transferEventTopic {
+		return common.Address{}, false
+	}
+	return common.BytesToAddress(l.Topics[2].Bytes()), true
+}
+
+// EstimateTokenTransferGas returns the gas needed to transfer amount of
+// token from one address to another
+func (c *RPCClient) EstimateTokenTransferGas(ctx context.Context, token *Token, from, to string, amount *big.Int) (uint64, error) {
+	if !common.IsHexAddress(from) || !common.IsHexAddress(to) {
+		return 0, fmt.Errorf("invalid address format")
+	}
+
+	gas, err := c.client.EstimateGas(ctx, ethereum.CallMsg{
+		From: common.HexToAddress(from),
+		To:   &token.Address,
+		Data: tokenTransferData(common.HexToAddress(to), amount),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate %s transfer gas: %v", token.Symbol, err)
+	}
+	return gas, nil
+}
+
+// TokenTransferCost returns the most a transfer of amount of token to the
+// given address can cost in fees with the given gas limit, including the L1
+// data fee on op-stack chains
+func (c *RPCClient) TokenTransferCost(ctx context.Context, token *Token, to string, amount *big.Int, gas uint64, fees *Fees) (*big.Int, error) {
+	if !common.IsHexAddress(to) {
+		return nil, fmt.Errorf("invalid recipient address format")
+	}
+	data := tokenTransferData(common.HexToAddress(to), amount)
+	return c.TxCost(ctx, newTx(nil, 0, token.Address, new(big.Int), gas, fees, data))
+}
+
+// SignTokenTransferWithNonce builds and signs a transfer of amount of token
+// to the given address without broadcasting it. The sender must hold enough
+// ETH for gas at the given fees.
+func (c *RPCClient) SignTokenTransferWithNonce(ctx context.Context, from Signer, token *Token, to string, amount *big.Int, nonce, gas uint64, fees *Fees) (*types.Transaction, error) {
+	if !common.IsHexAddress(to) {
+		return nil, fmt.Errorf("invalid recipient address format")
+	}
+	return c.SignCallWithNonce(ctx, from, token.Address, tokenTransferData(common.HexToAddress(to), amount), nonce, gas, fees)
+}
+
+// SignCallWithNonce builds and signs a contract call sending no ETH without
+// broadcasting it. The sender must hold enough ETH for gas at the given
+// fees.
+func (c *RPCClient) SignCallWithNonce(ctx context.Context, from Signer, contract common.Address, data []byte, nonce, gas uint64, fees *Fees) (*types.Transaction, error) {
+	chainID, err := c.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := newTx(chainID, nonce, contract, new(big.Int), gas, fees, data)
+	cost, err := c.TxCost(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := c.GetBalance(ctx, from.Address().Hex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sender balance: %v", err)
+	}
+	if balance.Cmp(cost) < 0 {
+		return nil, fmt.Errorf("insufficient funds for gas: need %v but got %v", cost, balance)
+	}
+
+	signedTx, err := from.SignTx(ctx, tx, chainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %v", err)
+	}
+	return signedTx, nil
+}
+
+// tokenTransferData is the call data of an ERC-20 transfer
+func tokenTransferData(to common.Address, amount *big.Int) []byte {
+	data := append([]byte{}, transferSelector...)
+	data = append(data, common.LeftPadBytes(to.Bytes(), 32)...)
+	return append(data, common.LeftPadBytes(amount.Bytes(), 32)...)
+}
@@ -0,0 +1,103 @@
+package ethcashier
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestParseTokens(t *testing.T) {
+	usdc := common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48")
+	link := common.HexToAddress("0x514910771AF9Ca656af840dff83E8264EcF986CA")
+
+	tests := []struct {
+		name    string
+		in      string
+		want    []Token
+		wantErr bool
+	}{
+		{name: "empty", in: ""},
+		{
+			name: "plain token",
+			in:   "link:0x514910771AF9Ca656af840dff83E8264EcF986CA:18",
+			want: []Token{{Symbol: "LINK", Address: link, Decimals: 18}},
+		},
+		{
+			name: "peg and minimum",
+			in:   " USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:peg:min=1000000 , LINK:0x514910771AF9Ca656af840dff83E8264EcF986CA:18:min=0",
+			want: []Token{
+				{Symbol: "USDC", Address: usdc, Decimals: 6, Pegged: true, MinDeposit: big.NewInt(1000000)},
+				{Symbol: "LINK", Address: link, Decimals: 18, MinDeposit: big.NewInt(0)},
+			},
+		},
+		{
+			name: "options in any order",
+			in:   "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:min=5:peg",
+			want: []Token{{Symbol: "USDC", Address: usdc, Decimals: 6, Pegged: true, MinDeposit: big.NewInt(5)}},
+		},
+		{name: "missing decimals", in: "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", wantErr: true},
+		{name: "too many parts", in: "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:peg:min=1:x", wantErr: true},
+		{name: "ETH symbol", in: "eth:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:18", wantErr: true},
+		{name: "empty symbol", in: ":0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:18", wantErr: true},
+		{name: "invalid address", in: "USDC:0x1234:6", wantErr: true},
+		{name: "decimals out of range", in: "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:256", wantErr: true},
+		{name: "duplicate symbol", in: "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6,usdc:0x514910771AF9Ca656af840dff83E8264EcF986CA:6", wantErr: true},
+		{name: "unknown option", in: "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:pegged", wantErr: true},
+		{name: "repeated option", in: "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:peg:peg", wantErr: true},
+		{name: "invalid minimum", in: "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:min=1.5", wantErr: true},
+		{name: "negative minimum", in: "USDC:0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48:6:min=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTokens(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ParseTokens error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseTokens = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransferRecipient(t *testing.T) {
+	from := common.HexToAddress("0x00000000000000000000000000000000000000f1")
+	to := common.HexToAddress("0x00000000000000000000000000000000000000f2")
+	approval := common.HexToHash("0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925")
+
+	tests := []struct {
+		name   string
+		topics []common.Hash
+		want   common.Address
+		wantOK bool
+	}{
+		{
+			name:   "transfer",
+			topics: []common.Hash{transferEventTopic, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+			want:   to,
+			wantOK: true,
+		},
+		{
+			name:   "other event",
+			topics: []common.Hash{approval, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+		},
+		{
+			// ERC-721 transfers index the token id as a fourth topic
+			name:   "indexed token id",
+			topics: []common.Hash{transferEventTopic, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes()), {}},
+		},
+		{
+			name:   "missing recipient",
+			topics: []common.Hash{transferEventTopic, common.BytesToHash(from.Bytes())},
+		},
+		{name: "no topics"},
+	}
+	for _, tt := range tests {
+		got, ok := transferRecipient(types.Log{Topics: tt.topics})
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("%s: transferRecipient = %s, %v, want %s, %v", tt.name, got.Hex(), ok, tt.want.Hex(), tt.wantOK)
+		}
+	}
+}
@@ -3,56 +3,127 @@ package ethcashier
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"io"
 
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/google/uuid"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters used to derive the wallet encryption key from SECRET_PASSWORD
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	secretKeyLen = 32 // AES-256
 )
 
 type wallet struct {
+	// EncryptedPrivateKey is only set for wallets created before HD
+	// derivation or imported from a keystore; derived wallets store no key
 	EncryptedPrivateKey string
 	PublicKey           string
+	// DerivationIndex is the BIP-44 address index of HD derived wallets
+	DerivationIndex *uint32
 }
 
 type User struct {
 	ID      string
 	Wallet  wallet
-	Balance float64
+	Balance USD
 }
 
-func NewUser() *User {
+// NewUser creates a user whose deposit wallet is derived from the HD wallet
+// at the given index
+func NewUser(hd *HDWallet, index uint32) (*User, error) {
 	// Generate UUID for user ID
 	userID := uuid.New().String()
 
-	// Generate Ethereum private key
-	privateKey, err := crypto.GenerateKey()
+	// Derive the deposit address, the private key is never stored
+	publicKey, err := hd.Address(index)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("failed to derive address: %v", err)
 	}
 
-	// Get public key
-	publicKey := crypto.PubkeyToAddress(privateKey.PublicKey).Hex()
-
-	// Convert private key to bytes and hex string
-	privateKeyBytes := crypto.FromECDSA(privateKey)
-	privateKeyHex := hex.EncodeToString(privateKeyBytes)
-
 	// Create and return new user
 	return &User{
 		ID: userID,
 		Wallet: wallet{
-			EncryptedPrivateKey: privateKeyHex,
-			PublicKey:           publicKey,
+			PublicKey:       publicKey,
+			DerivationIndex: &index,
 		},
 		Balance: 0,
+	}, nil
+}
+
+// PrivateKey returns the signing key for the user's deposit wallet, either
+// derived from the HD wallet or decrypted from the database
+func (u *User) PrivateKey(hd *HDWallet, keyring *Keyring) (*ecdsa.PrivateKey, error) {
+	if u.Wallet.DerivationIndex != nil {
+		privateKey, err := hd.PrivateKey(*u.Wallet.DerivationIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive private key: %v", err)
+		}
+		return privateKey, nil
+	}
+
+	privateKeyHex, err := keyring.Decrypt(u.Wallet.EncryptedPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %v", err)
+	}
+	privateKey, err := ParseECDSAPrivateKeyFromHex(privateKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	return privateKey, nil
+}
+
+// DeriveSecretKey derives the AES key used for wallet encryption from the
+// secret password and the salt stored in the database
+func DeriveSecretKey(password string, salt []byte) ([]byte, error) {
+	if password == "" {
+		return nil, fmt.Errorf("secret password cannot be empty")
 	}
+	return scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, secretKeyLen)
 }
 
-// encryptPrivateKey encrypts the private key using AES-GCM
-func encryptPrivateKey(privateKey string, secretKey []byte) (string, error) {
+// isPlaintextPrivateKey reports whether a stored key is still an unencrypted
+// hex private key from before wallet encryption was enabled
+func isPlaintextPrivateKey(storedKey string) bool {
+	if len(storedKey) != 64 {
+		return false
+	}
+	_, err := ParseECDSAPrivateKeyFromHex(storedKey)
+	return err == nil
+}
+
+// legacyCiphertextLen is the length of a nonce and sealed 64 character hex key,
+// the format used before ciphertexts were prefixed with a key version
+const legacyCiphertextLen = 12 + 64 + 16
+
+// splitCiphertext returns the key version an encrypted key was sealed under
+// along with the remaining nonce and ciphertext. Keys encrypted before
+// versioning was introduced have no prefix and belong to version 1.
+func splitCiphertext(encryptedKey string) (byte, []byte, error) {
+	encryptedData, err := hex.DecodeString(encryptedKey)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decode hex string: %v", err)
+	}
+	if len(encryptedData) == legacyCiphertextLen {
+		return 1, encryptedData, nil
+	}
+	if len(encryptedData) <= 13 {
+		return 0, nil, fmt.Errorf("encrypted data too short")
+	}
+	return encryptedData[0], encryptedData[1:], nil
+}
+
+// encryptPrivateKey encrypts the private key using AES-GCM and prefixes the
+// result with the version of the key used
+func encryptPrivateKey(privateKey string, version byte, secretKey []byte) (string, error) {
 	block, err := aes.NewCipher(secretKey)
 	if err != nil {
 		return "", err
@@ -69,16 +140,18 @@ func encryptPrivateKey(privateKey string, secretKey []byte) (string, error) {
 	}
 	ciphertext := aesgcm.Seal(nil, nonce, []byte(privateKey), nil)
 
-	// Combine nonce and ciphertext for storage
-	encryptedData := append(nonce, ciphertext...)
+	// Combine version, nonce and ciphertext for storage
+	encryptedData := append([]byte{version}, nonce...)
+	encryptedData = append(encryptedData, ciphertext...)
 	return hex.EncodeToString(encryptedData), nil
 }
 
+// decryptPrivateKey reverses encryptPrivateKey and returns the hex private key
 func decryptPrivateKey(encryptedKey string, secretKey []byte) (string, error) {
-	// Decode the hex string back to bytes
-	encryptedData, err := hex.DecodeString(encryptedKey)
+	// Decode the hex string and strip the version prefix
+	_, encryptedData, err := splitCiphertext(encryptedKey)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode hex string: %v", err)
+		return "", err
 	}
 
 	// Extract nonce and ciphertext
@@ -0,0 +1,67 @@
+package ethcashier
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSplitCiphertext(t *testing.T) {
+	legacy := bytes.Repeat([]byte{0xaa}, legacyCiphertextLen)
+	versioned := append([]byte{2}, legacy...)
+	short := append([]byte{2}, bytes.Repeat([]byte{0xaa}, 12)...)
+
+	tests := []struct {
+		name        string
+		in          string
+		wantVersion byte
+		wantData    []byte
+		wantErr     bool
+	}{
+		{name: "legacy", in: hex.EncodeToString(legacy), wantVersion: 1, wantData: legacy},
+		{name: "versioned", in: hex.EncodeToString(versioned), wantVersion: 2, wantData: legacy},
+		{name: "versioned other length", in: hex.EncodeToString(append([]byte{3}, legacy[:40]...)), wantVersion: 3, wantData: legacy[:40]},
+		{name: "too short", in: hex.EncodeToString(short), wantErr: true},
+		{name: "empty", in: "", wantErr: true},
+		{name: "bad hex", in: "zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		version, data, err := splitCiphertext(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: splitCiphertext error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if version != tt.wantVersion || !bytes.Equal(data, tt.wantData) {
+			t.Errorf("%s: splitCiphertext = %d, %x, want %d, %x", tt.name, version, data, tt.wantVersion, tt.wantData)
+		}
+	}
+}
+
+func TestKeyringDecryptsLegacyCiphertext(t *testing.T) {
+	privateKey := strings.Repeat("ab", 32)
+	v1 := bytes.Repeat([]byte{1}, secretKeyLen)
+	v2 := bytes.Repeat([]byte{2}, secretKeyLen)
+
+	versioned, err := encryptPrivateKey(privateKey, 1, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ciphertexts sealed before versioning are the same without the prefix
+	legacy := versioned[2:]
+
+	keyring := NewKeyring(2, v2)
+	keyring.AddKey(1, v1)
+	for _, stored := range []string{legacy, versioned} {
+		got, err := keyring.Decrypt(stored)
+		if err != nil {
+			t.Fatalf("Decrypt(%s): %v", stored, err)
+		}
+		if got != privateKey {
+			t.Errorf("Decrypt(%s) = %s, want %s", stored, got, privateKey)
+		}
+		if rotate, err := keyring.needsRotation(stored); err != nil || !rotate {
+			t.Errorf("needsRotation(%s) = %v, %v, want true", stored, rotate, err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package ethcashier
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+// Actions recorded in the key audit log
+const (
+	KeyAuditExport = "export"
+	// KeyAuditExportDerived is an export of an HD derived key that was
+	// explicitly allowed
+	KeyAuditExportDerived = "export-derived"
+	KeyAuditImport        = "import"
+)
+
+// ErrDerivedKeyExport is returned when exporting an HD derived wallet key
+// without allowing it. Deposit keys are non-hardened children, so anyone
+// holding one of them and the xpub can compute the account key and with it
+// every user's deposit key.
+var ErrDerivedKeyExport = errors.New("wallet is derived from the HD seed, exporting its key would expose every deposit key to anyone with the xpub")
+
+// KeyAuditEntry records an export or import of a user's wallet key
+type KeyAuditEntry struct {
+	ID        int64
+	UserID    string
+	Action    string
+	Address   string
+	Operator  string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// ExportUserKeystore returns the user's deposit wallet key as a keystore v3
+// JSON encrypted with passphrase. The export is written to the audit log
+// before the key is released, so a failed audit write aborts the export.
+// HD derived keys are refused with ErrDerivedKeyExport unless allowDerived
+// is set, and such an export is logged as KeyAuditExportDerived.
+func ExportUserKeystore(db *DB, hd *HDWallet, keyring *Keyring, userID, passphrase, operator, reason string, allowDerived bool) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("keystore passphrase cannot be empty")
+	}
+
+	user, err := db.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user %s not found", userID)
+	}
+	action := KeyAuditExport
+	if user.Wallet.DerivationIndex != nil {
+		if !allowDerived {
+			return nil, fmt.Errorf("user %s: %w", userID, ErrDerivedKeyExport)
+		}
+		action = KeyAuditExportDerived
+	}
+
+	privateKey, err := user.PrivateKey(hd, keyring)
+	if err != nil {
+		return nil, err
+	}
+	address := crypto.PubkeyToAddress(privateKey.PublicKey)
+	if !strings.EqualFold(address.Hex(), user.Wallet.PublicKey) {
+		return nil, fmt.Errorf("key for user %s does not match deposit address %s", userID, user.Wallet.PublicKey)
+	}
+
+	err = db.addKeyAuditEntry(KeyAuditEntry{
+		UserID:   userID,
+		Action:   action,
+		Address:  address.Hex(),
+		Operator: operator,
+		Reason:   reason,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record export: %v", err)
+	}
+
+	key := &keystore.Key{
+		Id:         uuid.New(),
+		Address:    address,
+		PrivateKey: privateKey,
+	}
+	return keystore.EncryptKey(key, passphrase, keystore.StandardScryptN, keystore.StandardScryptP)
+}
+
+// ImportUserKeystore replaces the user's deposit wallet with the key in a
+// keystore v3 JSON. The key is stored encrypted under the keyring, and an HD
+// derived wallet's index is retired so it is never assigned to another user.
+// It fails while the old address still holds credited funds or token sweep
+// gas, or any ETH or accepted token on one of the chains in rpcs, whose
+// accepted tokens are given by chain name. It returns the user's new
+// deposit address.
+func ImportUserKeystore(ctx context.Context, db *DB, rpcs []*RPCClient, tokens map[string][]Token, keyring *Keyring, userID string, keyJSON []byte, passphrase, operator, reason string) (string, error) {
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt keystore: %v", err)
+	}
+	address := crypto.PubkeyToAddress(key.PrivateKey.PublicKey).Hex()
+
+	// Funds on the old address that were never credited would be forgotten
+	user, err := db.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return "", fmt.Errorf("user %s not found", userID)
+	}
+	for _, rpc := range rpcs {
+		if err := checkAddressEmpty(ctx, rpc, tokens[rpc.Chain()], user.Wallet.PublicKey); err != nil {
+			return "", fmt.Errorf("user %s: %v, sweep it before importing", userID, err)
+		}
+	}
+
+	encryptedKey, err := keyring.Encrypt(privateKeyToHex(key.PrivateKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt private key: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var derivationIndex *uint32
+	err = tx.QueryRow("SELECT derivation_index FROM users WHERE id = ?", userID).Scan(&derivationIndex)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user %s: %v", userID, err)
+	}
+
+	var owners int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE lower(public_key) = lower(?) AND id != ?", address, userID).Scan(&owners)
+	if err != nil {
+		return "", err
+	}
+	if owners > 0 {
+		return "", fmt.Errorf("address %s already belongs to another user", address)
+	}
+
+	// Funds credited or held for gas on the old address would be forgotten
+	var unswept int
+	err = tx.QueryRow("SELECT COUNT(*) FROM unswept_balances WHERE user_id = ? AND unswept_wei != '0'", userID).Scan(&unswept)
+	if err != nil {
+		return "", err
+	}
+	if unswept > 0 {
+		return "", fmt.Errorf("user %s has credited funds still on the old address, sweep them before importing", userID)
+	}
+	var held int
+	err = tx.QueryRow(`
+    SELECT (SELECT COUNT(*) FROM gas_reserves WHERE user_id = ? AND reserve_wei != '0')
+        + (SELECT COUNT(*) FROM gas_fundings WHERE user_id = ? AND status = ?)`,
+		userID, userID, gasFundingPending).Scan(&held)
+	if err != nil {
+		return "", err
+	}
+	if held > 0 {
+		return "", fmt.Errorf("user %s has token sweep gas on the old address, sweep it before importing", userID)
+	}
+	var sweeping int
+	err = tx.QueryRow("SELECT COUNT(*) FROM deposits WHERE user_id = ? AND status = ?", userID, DepositPending).Scan(&sweeping)
+	if err != nil {
+		return "", err
+	}
+	if sweeping > 0 {
+		return "", fmt.Errorf("user %s has deposit sweeps still pending on the old address", userID)
+	}
+
+	if derivationIndex != nil {
+		var retired string
+		err = tx.QueryRow("SELECT value FROM settings WHERE key = ?", settingRetiredIndexes).Scan(&retired)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		floor, _ := strconv.ParseUint(retired, 10, 32)
+		if uint64(*derivationIndex)+1 > floor {
+			_, err = tx.Exec(`
+            INSERT INTO settings (key, value) VALUES (?, ?)
+            ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+				settingRetiredIndexes, strconv.FormatUint(uint64(*derivationIndex)+1, 10))
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`
+    UPDATE users
+    SET encrypted_private_key = ?, public_key = ?, derivation_index = NULL
+    WHERE id = ?`, encryptedKey, address, userID)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("DELETE FROM gas_reserves WHERE user_id = ?", userID)
+	if err != nil {
+		return "", err
+	}
+
+	// Sweeps exported for the old address can no longer be settled
+	_, err = tx.Exec("DELETE FROM sweeps WHERE user_id = ? AND settled = 0", userID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+    INSERT INTO key_audit_log (user_id, action, address, operator, reason)
+    VALUES (?, ?, ?, ?, ?)`, userID, KeyAuditImport, address, operator, reason)
+	if err != nil {
+		return "", fmt.Errorf("failed to record import: %v", err)
+	}
+
+	return address, tx.Commit()
+}
+
+// checkAddressEmpty fails if address holds any ETH or any of tokens on the
+// client's chain
+func checkAddressEmpty(ctx context.Context, rpc *RPCClient, tokens []Token, address string) error {
+	balance, err := rpc.GetBalance(ctx, address)
+	if err != nil {
+		return err
+	}
+	if balance.Sign() != 0 {
+		return fmt.Errorf("old address %s holds %s wei on %s", address, balance, rpc.Chain())
+	}
+	for i := range tokens {
+		balance, err := rpc.TokenBalance(ctx, &tokens[i], address)
+		if err != nil {
+			return err
+		}
+		if balance.Sign() != 0 {
+			return fmt.Errorf("old address %s holds %s %s base units on %s", address, balance, tokens[i].Symbol, rpc.Chain())
+		}
+	}
+	return nil
+}
+
+// ListKeyAuditEntries returns the key audit log, oldest first
+func (db *DB) ListKeyAuditEntries() ([]KeyAuditEntry, error) {
+	rows, err := db.Query(`
+    SELECT id, user_id, action, address, operator, reason, created_at
+    FROM key_audit_log ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []KeyAuditEntry
+	for rows.Next() {
+		var e KeyAuditEntry
+		err := rows.Scan(&e.ID, &e.UserID, &e.Action, &e.Address, &e.Operator, &e.Reason, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (db *DB) addKeyAuditEntry(e KeyAuditEntry) error {
+	_, err := db.Exec(`
+    INSERT INTO key_audit_log (user_id, action, address, operator, reason)
+    VALUES (?, ?, ?, ?, ?)`, e.UserID, e.Action, e.Address, e.Operator, e.Reason)
+	return err
+}
+
+func privateKeyToHex(privateKey *ecdsa.PrivateKey) string {
+	return hex.EncodeToString(crypto.FromECDSA(privateKey))
+}
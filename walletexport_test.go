@@ -0,0 +1,150 @@
+package ethcashier
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+func TestExportUserKeystore(t *testing.T) {
+	tests := []struct {
+		name         string
+		derived      bool
+		allowDerived bool
+		wantErr      error
+		wantAction   string
+	}{
+		{name: "stored key", wantAction: KeyAuditExport},
+		{name: "derived key", derived: true, wantErr: ErrDerivedKeyExport},
+		{name: "derived key allowed", derived: true, allowDerived: true, wantAction: KeyAuditExportDerived},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		hd, err := NewHDWalletFromMnemonic(testMnemonic, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyring := NewKeyring(1, make([]byte, secretKeyLen))
+
+		user, err := NewUser(hd, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tt.derived {
+			key, err := crypto.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			user.Wallet.DerivationIndex = nil
+			user.Wallet.PublicKey = crypto.PubkeyToAddress(key.PublicKey).Hex()
+			if user.Wallet.EncryptedPrivateKey, err = keyring.Encrypt(privateKeyToHex(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+
+		keyJSON, err := ExportUserKeystore(db, hd, keyring, user.ID, "passphrase", "operator", "test", tt.allowDerived)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: ExportUserKeystore error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+
+		entries, err := db.ListKeyAuditEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.wantErr != nil {
+			if len(entries) != 0 {
+				t.Errorf("%s: refused export was logged as %+v", tt.name, entries)
+			}
+			continue
+		}
+		if len(entries) != 1 || entries[0].Action != tt.wantAction {
+			t.Errorf("%s: audit log %+v, want one %s entry", tt.name, entries, tt.wantAction)
+		}
+		key, err := keystore.DecryptKey(keyJSON, "passphrase")
+		if err != nil {
+			t.Fatalf("%s: DecryptKey: %v", tt.name, err)
+		}
+		if address := crypto.PubkeyToAddress(key.PrivateKey.PublicKey).Hex(); !strings.EqualFold(address, user.Wallet.PublicKey) {
+			t.Errorf("%s: exported key for %s, want %s", tt.name, address, user.Wallet.PublicKey)
+		}
+	}
+}
+
+func TestImportUserKeystore(t *testing.T) {
+	token := Token{Symbol: "TKN", Address: common.HexToAddress("0x00000000000000000000000000000000000000c0"), Decimals: 6}
+
+	tests := []struct {
+		name         string
+		ethBalance   int64
+		tokenBalance int64
+		wantErr      bool
+	}{
+		{name: "empty old address"},
+		{name: "ETH on the old address", ethBalance: 1, wantErr: true},
+		{name: "token on the old address", tokenBalance: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		db := newTestDB(t)
+		node := newFakeNode()
+		rpc := newTestRPC(t, node)
+		hd, err := NewHDWalletFromMnemonic(testMnemonic, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyring := NewKeyring(1, make([]byte, secretKeyLen))
+		user, err := NewUser(hd, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+		old := common.HexToAddress(user.Wallet.PublicKey)
+		node.balances[old] = big.NewInt(tt.ethBalance)
+		node.tokenBalances[old] = big.NewInt(tt.tokenBalance)
+
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := crypto.PubkeyToAddress(key.PublicKey)
+		keyJSON, err := keystore.EncryptKey(&keystore.Key{Id: uuid.New(), Address: address, PrivateKey: key}, "passphrase", keystore.LightScryptN, keystore.LightScryptP)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tokens := map[string][]Token{rpc.Chain(): {token}}
+		got, err := ImportUserKeystore(ctx, db, []*RPCClient{rpc}, tokens, keyring, user.ID, keyJSON, "passphrase", "operator", "test")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ImportUserKeystore error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+
+		want := old.Hex()
+		if !tt.wantErr {
+			want = address.Hex()
+			if got != want {
+				t.Errorf("%s: ImportUserKeystore = %s, want %s", tt.name, got, want)
+			}
+		}
+		stored, err := db.GetUser(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Wallet.PublicKey != want {
+			t.Errorf("%s: deposit address = %s, want %s", tt.name, stored.Wallet.PublicKey, want)
+		}
+	}
+}
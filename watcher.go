@@ -0,0 +1,293 @@
+package ethcashier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// maxBlocksPerScan bounds how far ScanDeposits catches up in one call, so a
+// watcher that was down for a long time saves its progress as it goes
+const maxBlocksPerScan = 500
+
+// ScanDeposits follows the chain from the last scanned block to the newest
+// confirmed one and runs Check for every user whose deposit address received
+// a transaction, and CheckToken for every accepted token transferred to it,
+// so deposits are credited without a /check call. The last scanned block is
+// persisted after each block. A check that fails for one user is recorded
+// and retried on every later scan until it succeeds, without holding up the
+// other users. The first scan starts after the configured start block, or
+// at the newest confirmed block if there is none. ETH sent by contracts is
+// not visible as a transaction recipient and still needs a /check.
+func (api *API) ScanDeposits(ctx context.Context) error {
+	head, err := api.confirmedBlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+
+	stored, err := api.db.getSetting(settingDepositCursor + api.rpc.Chain())
+	if err != nil {
+		return err
+	}
+	if stored == "" {
+		start := head
+		if api.startBlock > 0 {
+			start = api.startBlock - 1
+		}
+		stored = strconv.FormatUint(start, 10)
+		if err := api.db.setSetting(settingDepositCursor+api.rpc.Chain(), stored); err != nil {
+			return err
+		}
+	}
+	cursor, err := strconv.ParseUint(stored, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid deposit scan block %q: %v", stored, err)
+	}
+
+	if err := api.retryDeposits(ctx); err != nil {
+		return err
+	}
+
+	// Users created after the confirmed block was read cannot have been paid
+	// in the blocks scanned below
+	addresses, err := api.db.depositAddresses()
+	if err != nil {
+		return err
+	}
+
+	last := head
+	if last > cursor+maxBlocksPerScan {
+		last = cursor + maxBlocksPerScan
+	}
+	for number := cursor + 1; number <= last; number++ {
+		if err := api.scanBlock(ctx, number, addresses); err != nil {
+			return fmt.Errorf("block %d: %v", number, err)
+		}
+		if err := api.db.setSetting(settingDepositCursor+api.rpc.Chain(), strconv.FormatUint(number, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanBlock credits the deposits of every user paid in a block, in ETH or
+// in an accepted token. Checks that fail are recorded for retry.
+func (api *API) scanBlock(ctx context.Context, number uint64, addresses map[string]string) error {
+	block, err := api.rpc.BlockByNumber(ctx, number)
+	if err != nil {
+		return err
+	}
+
+	// Assets paid to each user
+	paid := make(map[string]map[string]bool)
+	markPaid := func(to common.Address, asset string) {
+		userID, ok := addresses[strings.ToLower(to.Hex())]
+		if !ok {
+			return
+		}
+		if paid[userID] == nil {
+			paid[userID] = make(map[string]bool)
+		}
+		paid[userID][asset] = true
+	}
+	for _, tx := range block.Transactions() {
+		if tx.To() != nil {
+			markPaid(*tx.To(), assetETH)
+		}
+	}
+	logs, err := api.rpc.TokenTransfers(ctx, api.tokens, block.Hash())
+	if err != nil {
+		return err
+	}
+	for _, l := range logs {
+		token := api.tokenByAddress(l.Address)
+		to, ok := transferRecipient(l)
+		if token == nil || !ok {
+			continue
+		}
+		markPaid(to, token.Symbol)
+	}
+
+	for userID, assets := range paid {
+		user, err := api.db.GetUser(userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			continue
+		}
+
+		// Gas sent for an unfinished token sweep, such as the funding paid
+		// in this block, is finished by checking its token
+		fundings, err := api.db.pendingGasFundings(userID, api.rpc.Chain())
+		if err != nil {
+			return err
+		}
+		for _, f := range fundings {
+			assets[f.Asset] = true
+		}
+
+		for asset := range assets {
+			if err := api.checkAsset(ctx, user, asset); err != nil {
+				if err := api.db.recordDepositRetry(userID, api.rpc.Chain(), asset, err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckAll runs Check for every user whose deposit address holds ETH on the
+// client's chain, catching deposits the watcher cannot see, such as ETH sent
+// by contracts or paid before the watcher started. Balances are read in
+// JSON-RPC batches so addresses holding nothing cost no check. Checks that
+// fail are recorded for the watcher to retry. It returns how many addresses
+// held ETH.
+func (api *API) CheckAll(ctx context.Context) (int, error) {
+	users, err := api.db.ListUsers()
+	if err != nil {
+		return 0, err
+	}
+	addresses := make([]string, len(users))
+	for i, user := range users {
+		addresses[i] = user.Wallet.PublicKey
+	}
+	balances, err := api.rpc.GetBalances(ctx, addresses)
+	if err != nil {
+		return 0, err
+	}
+
+	funded := 0
+	for i := range users {
+		if balances[i].Sign() == 0 {
+			continue
+		}
+		funded++
+		if err := api.checkAsset(ctx, &users[i], assetETH); err != nil {
+			if err := api.db.recordDepositRetry(users[i].ID, api.rpc.Chain(), assetETH, err); err != nil {
+				return funded, err
+			}
+		}
+	}
+	return funded, nil
+}
+
+// checkAsset runs Check or CheckToken for asset. Checks credit the whole
+// balance, so finding no deposit, as when /check already credited it, is
+// not a failure.
+func (api *API) checkAsset(ctx context.Context, user *User, asset string) error {
+	var err error
+	if asset == assetETH {
+		_, _, err = api.Check(ctx, user)
+	} else {
+		_, _, err = api.CheckToken(ctx, user, asset)
+	}
+	if errors.Is(err, ErrNoDeposit) || errors.Is(err, ErrDepositBelowMinimum) {
+		return nil
+	}
+	return err
+}
+
+// depositRetry is a deposit check the watcher has to run again
+type depositRetry struct {
+	UserID string
+	Asset  string
+}
+
+// retryDeposits runs the failed checks recorded on the client's chain
+// again, forgetting each once it succeeds
+func (api *API) retryDeposits(ctx context.Context) error {
+	retries, err := api.db.depositRetries(api.rpc.Chain())
+	if err != nil {
+		return err
+	}
+
+	for _, r := range retries {
+		user, err := api.db.GetUser(r.UserID)
+		if err != nil {
+			return err
+		}
+		if user != nil {
+			if err := api.checkAsset(ctx, user, r.Asset); err != nil {
+				if err := api.db.recordDepositRetry(r.UserID, api.rpc.Chain(), r.Asset, err); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := api.db.clearDepositRetry(r.UserID, api.rpc.Chain(), r.Asset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordDepositRetry records that checking asset for the user on chain
+// failed with checkErr, so the watcher runs it again
+func (db *DB) recordDepositRetry(userID, chain, asset string, checkErr error) error {
+	_, err := db.Exec(`
+    INSERT INTO deposit_retries (user_id, chain, asset, error, attempts) VALUES (?, ?, ?, ?, 1)
+    ON CONFLICT(user_id, chain, asset) DO UPDATE SET
+        error = excluded.error, attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP`,
+		userID, chain, asset, checkErr.Error())
+	return err
+}
+
+func (db *DB) clearDepositRetry(userID, chain, asset string) error {
+	_, err := db.Exec("DELETE FROM deposit_retries WHERE user_id = ? AND chain = ? AND asset = ?", userID, chain, asset)
+	return err
+}
+
+// depositRetries returns the checks to retry on chain, oldest first
+func (db *DB) depositRetries(chain string) ([]depositRetry, error) {
+	rows, err := db.Query("SELECT user_id, asset FROM deposit_retries WHERE chain = ? ORDER BY created_at", chain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var retries []depositRetry
+	for rows.Next() {
+		var r depositRetry
+		if err := rows.Scan(&r.UserID, &r.Asset); err != nil {
+			return nil, err
+		}
+		retries = append(retries, r)
+	}
+	return retries, rows.Err()
+}
+
+// tokenByAddress returns the accepted token with the given contract
+// address, or nil
+func (api *API) tokenByAddress(address common.Address) *Token {
+	for i := range api.tokens {
+		if api.tokens[i].Address == address {
+			return &api.tokens[i]
+		}
+	}
+	return nil
+}
+
+// depositAddresses maps every user's lowercase deposit address to their id
+func (db *DB) depositAddresses() (map[string]string, error) {
+	rows, err := db.Query("SELECT id, public_key FROM users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := make(map[string]string)
+	for rows.Next() {
+		var id, address string
+		if err := rows.Scan(&id, &address); err != nil {
+			return nil, err
+		}
+		addresses[strings.ToLower(address)] = id
+	}
+	return addresses, rows.Err()
+}
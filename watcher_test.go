@@ -0,0 +1,195 @@
+package ethcashier
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const testMnemonic = "test test test test test test test test test test test junk"
+
+// newTestAPI returns an API deriving deposit addresses from testMnemonic,
+// sweeping to a throwaway admin wallet and crediting deposits in the latest
+// block
+func newTestAPI(t *testing.T, db *DB, rpc *RPCClient) *API {
+	t.Helper()
+	hd, err := NewHDWalletFromMnemonic(testMnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(db, nil, rpc, NewKeySigner(key), nil, nil, hd)
+	if err := api.SetConfirmations(1); err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+func TestScanDeposits(t *testing.T) {
+	token := Token{Symbol: "TKN", Address: common.HexToAddress("0x00000000000000000000000000000000000000c0"), Decimals: 6}
+	other := common.HexToAddress("0x00000000000000000000000000000000000000c1")
+
+	tests := []struct {
+		name          string
+		startBlock    uint64
+		confirmations uint64
+		before        int // blocks mined before the first scan
+		after         int // blocks mined before the later scans
+		scans         int
+		paidAt        uint64 // block paying the user, if any
+		paidAsset     string
+		paidBy        common.Address // token contract of a token payment
+		wantCursor    string
+		wantChecked   []depositRetry
+	}{
+		{
+			name:       "first scan starts at the head",
+			before:     5,
+			scans:      1,
+			paidAt:     3,
+			paidAsset:  assetETH,
+			wantCursor: "5",
+		},
+		{
+			name:          "first scan starts at the confirmed head",
+			confirmations: 3,
+			before:        5,
+			scans:         1,
+			wantCursor:    "3",
+		},
+		{
+			name:        "first scan starts at the start block",
+			startBlock:  3,
+			before:      5,
+			scans:       1,
+			paidAt:      3,
+			paidAsset:   assetETH,
+			wantCursor:  "5",
+			wantChecked: []depositRetry{{Asset: assetETH}},
+		},
+		{
+			name:        "later scans follow new blocks",
+			before:      2,
+			after:       3,
+			scans:       2,
+			paidAt:      4,
+			paidAsset:   assetETH,
+			wantCursor:  "5",
+			wantChecked: []depositRetry{{Asset: assetETH}},
+		},
+		{
+			name:       "catches up in steps",
+			after:      maxBlocksPerScan + 100,
+			scans:      2,
+			wantCursor: "500",
+		},
+		{
+			name:       "caught up",
+			after:      maxBlocksPerScan + 100,
+			scans:      3,
+			wantCursor: "600",
+		},
+		{
+			name:        "token transfer",
+			before:      1,
+			after:       2,
+			scans:       2,
+			paidAt:      2,
+			paidAsset:   token.Symbol,
+			paidBy:      token.Address,
+			wantCursor:  "3",
+			wantChecked: []depositRetry{{Asset: token.Symbol}},
+		},
+		{
+			name:       "transfer of a token that is not accepted",
+			before:     1,
+			after:      2,
+			scans:      2,
+			paidAt:     2,
+			paidAsset:  token.Symbol,
+			paidBy:     other,
+			wantCursor: "3",
+		},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		db := newTestDB(t)
+		node := newFakeNode()
+		rpc := newTestRPC(t, node)
+		api := newTestAPI(t, db, rpc)
+		api.SetTokens([]Token{token})
+		api.SetStartBlock(tt.startBlock)
+		if tt.confirmations > 0 {
+			api.SetConfirmations(tt.confirmations)
+		}
+		user, err := NewUser(api.hd, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+		address := common.HexToAddress(user.Wallet.PublicKey)
+		// The user's checks fail on the fake node once they find a balance
+		node.balances[address] = big.NewInt(params.Ether)
+		node.tokenBalances[address] = big.NewInt(1000000)
+
+		mine := func(blocks int) {
+			for i := 0; i < blocks; i++ {
+				number := uint64(len(node.blocks))
+				if number != tt.paidAt {
+					node.mine()
+					continue
+				}
+				if tt.paidAsset == assetETH {
+					node.mine(signTestTx(t, address.Hex(), 0))
+					continue
+				}
+				block := node.mine()
+				node.logs = append(node.logs, types.Log{
+					Address:   tt.paidBy,
+					Topics:    []common.Hash{transferEventTopic, {}, common.BytesToHash(address.Bytes())},
+					BlockHash: block.Hash(),
+				})
+			}
+		}
+
+		mine(tt.before)
+		for i := 0; i < tt.scans; i++ {
+			if i > 0 {
+				mine(tt.after)
+				tt.after = 0
+			}
+			if err := api.ScanDeposits(ctx); err != nil {
+				t.Fatalf("%s: ScanDeposits: %v", tt.name, err)
+			}
+		}
+
+		cursor, err := db.getSetting(settingDepositCursor + rpc.Chain())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor != tt.wantCursor {
+			t.Errorf("%s: cursor = %s, want %s", tt.name, cursor, tt.wantCursor)
+		}
+		checked, err := db.depositRetries(rpc.Chain())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range tt.wantChecked {
+			tt.wantChecked[i].UserID = user.ID
+		}
+		if !reflect.DeepEqual(checked, tt.wantChecked) {
+			t.Errorf("%s: checked %+v, want %+v", tt.name, checked, tt.wantChecked)
+		}
+	}
+}
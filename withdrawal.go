@@ -0,0 +1,438 @@
+package ethcashier
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Withdrawal statuses. A withdrawal moves requested -> signed -> broadcast
+// -> confirmed. Until it is confirmed it can instead become failed, and a
+// failed withdrawal becomes refunded once the user has been credited back.
+const (
+	WithdrawalRequested = "requested"
+	WithdrawalSigned    = "signed"
+	WithdrawalBroadcast = "broadcast"
+	WithdrawalConfirmed = "confirmed"
+	WithdrawalFailed    = "failed"
+	WithdrawalRefunded  = "refunded"
+)
+
+// errWithdrawalExpired is returned when a withdrawal was failed by the
+// tracker before it could be signed
+var errWithdrawalExpired = errors.New("withdrawal expired before it was signed")
+
+// withdrawalRequestTimeout is how long a withdrawal may stay requested
+// before the tracker assumes the request died before signing
+const withdrawalRequestTimeout = 5 * time.Minute
+
+// Withdrawal is a user's request to be paid out in ETH or a token and its
+// progress on-chain
+type Withdrawal struct {
+	ID        int64     `json:"id"`
+	User      string    `json:"user"`
+	To        string    `json:"to"`
+	Chain     string    `json:"chain"` // chain the withdrawal is paid on
+	Asset     string    `json:"asset"` // ETH or the symbol of the token paid out
+	Amount    USD       `json:"amount"`
+	Price     USD       `json:"price"`     // USD per ETH or token applied, zero until priced
+	AmountWei string    `json:"amountWei"` // wei or token base units sent, empty until priced
+	Status    string    `json:"status"`
+	From      string    `json:"from"`
+	Nonce     *uint64   `json:"nonce"`
+	TxHash    string    `json:"txHash"`
+	Error     string    `json:"error,omitempty"` // why the withdrawal failed or was not broadcast
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	rawTx string
+	// feeETHPrice is the USD per ETH a token withdrawal's network fee is
+	// booked at
+	feeETHPrice USD
+}
+
+// treasuryAccount returns the ledger account the withdrawn asset is paid
+// from
+func (w *Withdrawal) treasuryAccount() string {
+	return assetTreasury(w.Asset)
+}
+
+// ethPriceForFees returns the USD per ETH the withdrawal's network fee is
+// booked at
+func (w *Withdrawal) ethPriceForFees() USD {
+	if w.Asset == assetETH {
+		return w.Price
+	}
+	return w.feeETHPrice
+}
+
+// CreateWithdrawal debits amount from the user and records a requested
+// withdrawal of asset, ETH or a token symbol, to the given address on chain
+func (db *DB) CreateWithdrawal(userID, chain, asset, to string, amount USD) (*Withdrawal, error) {
+	if amount <= 0 {
+		return nil, ErrNonPositiveAmount
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+    INSERT INTO withdrawals (user_id, to_address, chain, asset, amount_micros, status)
+    VALUES (?, ?, ?, ?, ?, ?)`, userID, to, chain, asset, amount, WithdrawalRequested)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	memo := fmt.Sprintf("withdrawal %d to %s on %s", id, to, chain)
+	if asset != assetETH {
+		memo = fmt.Sprintf("withdrawal %d in %s to %s on %s", id, asset, to, chain)
+	}
+	_, err = postTx(tx, LedgerWithdrawal, memo, []Posting{
+		{Account: UserAccount(userID), Amount: amount},
+		{Account: assetTreasury(asset), Amount: -amount},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return db.GetWithdrawal(id)
+}
+
+// GetWithdrawal returns a withdrawal by ID, or nil if it does not exist
+func (db *DB) GetWithdrawal(id int64) (*Withdrawal, error) {
+	row := db.QueryRow(withdrawalColumns+" WHERE id = ?", id)
+	w, err := scanWithdrawal(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return w, err
+}
+
+// ListWithdrawals returns the user's withdrawals, newest first
+func (db *DB) ListWithdrawals(userID string) ([]Withdrawal, error) {
+	return db.queryWithdrawals(withdrawalColumns+" WHERE user_id = ? ORDER BY id DESC", userID)
+}
+
+// unfinishedWithdrawals returns withdrawals on chain the tracker still has to
+// advance
+func (db *DB) unfinishedWithdrawals(chain string) ([]Withdrawal, error) {
+	return db.queryWithdrawals(withdrawalColumns+" WHERE chain = ? AND status IN (?, ?, ?, ?) ORDER BY id",
+		chain, WithdrawalRequested, WithdrawalSigned, WithdrawalBroadcast, WithdrawalFailed)
+}
+
+const withdrawalColumns = `
+    SELECT id, user_id, to_address, chain, asset, amount_micros, price_micros, amount_wei, status,
+        from_address, nonce, tx_hash, raw_tx, fee_eth_price_micros, error, created_at, updated_at
+    FROM withdrawals`
+
+func (db *DB) queryWithdrawals(query string, args ...any) ([]Withdrawal, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	withdrawals := []Withdrawal{}
+	for rows.Next() {
+		w, err := scanWithdrawal(rows)
+		if err != nil {
+			return nil, err
+		}
+		withdrawals = append(withdrawals, *w)
+	}
+	return withdrawals, rows.Err()
+}
+
+func scanWithdrawal(row interface{ Scan(...any) error }) (*Withdrawal, error) {
+	w := &Withdrawal{}
+	err := row.Scan(&w.ID, &w.User, &w.To, &w.Chain, &w.Asset, &w.Amount, &w.Price, &w.AmountWei, &w.Status,
+		&w.From, &w.Nonce, &w.TxHash, &w.rawTx, &w.feeETHPrice, &w.Error, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// transitionWithdrawal moves a withdrawal to status if it is currently in
+// one of the from statuses, also applying the extra assignments in set. It
+// reports whether the withdrawal was moved.
+func transitionWithdrawal(tx *sql.Tx, id int64, from []string, status, set string, args ...any) (bool, error) {
+	query := "UPDATE withdrawals SET status = ?, updated_at = CURRENT_TIMESTAMP"
+	if set != "" {
+		query += ", " + set
+	}
+	query += " WHERE id = ? AND status IN (?" + strings.Repeat(", ?", len(from)-1) + ")"
+
+	params := append([]any{status}, args...)
+	params = append(params, id)
+	for _, s := range from {
+		params = append(params, s)
+	}
+
+	result, err := tx.Exec(query, params...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// setWithdrawalSigned records the signed transaction for a requested
+// withdrawal paying amount of the withdrawn asset at price, with its
+// network fee to be booked at ethPrice. It reports false if the withdrawal
+// is no longer requested, in which case the transaction must not be
+// broadcast.
+func (db *DB) setWithdrawalSigned(id int64, price USD, amount *big.Int, ethPrice USD, signedTx *types.Transaction, from string) (bool, error) {
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	moved, err := transitionWithdrawal(tx, id, []string{WithdrawalRequested}, WithdrawalSigned,
+		"price_micros = ?, amount_wei = ?, fee_eth_price_micros = ?, from_address = ?, nonce = ?, tx_hash = ?, raw_tx = ?",
+		price, amount.String(), ethPrice, from, signedTx.Nonce(), signedTx.Hash().Hex(), hex.EncodeToString(raw))
+	if err != nil || !moved {
+		return false, err
+	}
+	if err := insertWithdrawalAttempt(tx, id, attemptTransfer, signedTx); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// setWithdrawalBroadcast marks a signed withdrawal as broadcast
+func (db *DB) setWithdrawalBroadcast(id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := transitionWithdrawal(tx, id, []string{WithdrawalSigned}, WithdrawalBroadcast, "error = ''"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setWithdrawalError records why a withdrawal has not progressed without
+// changing its status
+func (db *DB) setWithdrawalError(id int64, reason string) error {
+	_, err := db.Exec("UPDATE withdrawals SET error = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", reason, id)
+	return err
+}
+
+// confirmWithdrawal marks a withdrawal as confirmed by the mined
+// transaction txHash and books the network fee it paid
+func (db *DB) confirmWithdrawal(w *Withdrawal, txHash string, feeWei *big.Int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	moved, err := transitionWithdrawal(tx, w.ID, []string{WithdrawalSigned, WithdrawalBroadcast}, WithdrawalConfirmed,
+		"error = '', tx_hash = ?", txHash)
+	if err != nil || !moved {
+		return err
+	}
+	if err := postWithdrawalFee(tx, w, feeWei); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failWithdrawal marks an unconfirmed withdrawal as failed, booking the
+// network fee if a reverted transaction still paid one
+func (db *DB) failWithdrawal(w *Withdrawal, reason string, feeWei *big.Int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	moved, err := transitionWithdrawal(tx, w.ID,
+		[]string{WithdrawalRequested, WithdrawalSigned, WithdrawalBroadcast}, WithdrawalFailed, "error = ?", reason)
+	if err != nil || !moved {
+		return err
+	}
+	if feeWei != nil {
+		if err := postWithdrawalFee(tx, w, feeWei); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// refundWithdrawal credits a failed withdrawal back to the user. The status
+// change and the ledger posting share a transaction, so a withdrawal is
+// refunded exactly once however often this is called.
+func (db *DB) refundWithdrawal(w *Withdrawal) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	moved, err := transitionWithdrawal(tx, w.ID, []string{WithdrawalFailed}, WithdrawalRefunded, "")
+	if err != nil || !moved {
+		return err
+	}
+	memo := fmt.Sprintf("withdrawal %d refunded", w.ID)
+	_, err = postTx(tx, LedgerWithdrawalRefund, memo, []Posting{
+		{Account: w.treasuryAccount(), Amount: w.Amount},
+		{Account: UserAccount(w.User), Amount: -w.Amount},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failAndRefund fails a withdrawal and immediately credits the user back
+func (db *DB) failAndRefund(w *Withdrawal, reason string, feeWei *big.Int) error {
+	if err := db.failWithdrawal(w, reason, feeWei); err != nil {
+		return err
+	}
+	return db.refundWithdrawal(w)
+}
+
+// postWithdrawalFee books the network fee paid by the treasury for a
+// withdrawal at the ETH price the withdrawal was made at
+func postWithdrawalFee(tx *sql.Tx, w *Withdrawal, feeWei *big.Int) error {
+	fee, err := weiToUSD(feeWei, w.ethPriceForFees())
+	if err != nil {
+		return err
+	}
+	if fee == 0 {
+		return nil
+	}
+	memo := fmt.Sprintf("withdrawal %d fee of %s wei", w.ID, feeWei)
+	_, err = postTx(tx, LedgerFee, memo, []Posting{
+		{Account: AccountFees, Amount: fee},
+		{Account: AccountTreasury, Amount: -fee},
+	})
+	return err
+}
+
+// TrackWithdrawals advances every unfinished withdrawal on the client's
+// chain: signed and broadcast withdrawals are confirmed or failed from their
+// receipts and rebroadcast while pending, withdrawals stuck before signing
+// are failed, and failed withdrawals are refunded.
+func TrackWithdrawals(ctx context.Context, db *DB, rpc *RPCClient) error {
+	withdrawals, err := db.unfinishedWithdrawals(rpc.Chain())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range withdrawals {
+		if err := trackWithdrawal(ctx, db, rpc, &withdrawals[i]); err != nil {
+			errs = append(errs, fmt.Errorf("withdrawal %d: %v", withdrawals[i].ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func trackWithdrawal(ctx context.Context, db *DB, rpc *RPCClient, w *Withdrawal) error {
+	switch w.Status {
+	case WithdrawalFailed:
+		return db.refundWithdrawal(w)
+
+	case WithdrawalRequested:
+		if time.Since(w.UpdatedAt) < withdrawalRequestTimeout {
+			return nil
+		}
+		return db.failAndRefund(w, "request was not signed", nil)
+	}
+
+	// Signed or broadcast. Any transaction sent at the withdrawal's nonce,
+	// including fee bumps and cancellations, may be the one that is mined.
+	attempts, err := db.withdrawalAttempts(w)
+	if err != nil {
+		return err
+	}
+	receipt, attempt, err := findAttemptReceipt(ctx, rpc, attempts)
+	if err != nil {
+		return err
+	}
+	if receipt == nil {
+		// The nonce being used without any of our transactions being mined
+		// means it was taken by another transaction. Check the receipts
+		// again, on the endpoint reporting the nonce, in case one was mined
+		// in between.
+		hashes := make([]string, len(attempts))
+		for i := range attempts {
+			hashes[i] = attempts[i].TxHash
+		}
+		nonce, receipts, err := rpc.NonceAndReceipts(ctx, w.From, hashes)
+		if err != nil {
+			return err
+		}
+		if nonce <= *w.Nonce {
+			return rebroadcastWithdrawal(ctx, db, rpc, w)
+		}
+		for i := range receipts {
+			if receipts[i] != nil {
+				receipt, attempt = receipts[i], &attempts[i]
+				break
+			}
+		}
+		if receipt == nil {
+			return db.failAndRefund(w, fmt.Sprintf("nonce %d was used by another transaction", *w.Nonce), nil)
+		}
+	}
+
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(receipt.GasUsed), receipt.EffectiveGasPrice)
+	if attempt.Kind == attemptCancel {
+		return db.failAndRefund(w, "cancelled", fee)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return db.failAndRefund(w, "transaction reverted", fee)
+	}
+	return db.confirmWithdrawal(w, attempt.TxHash, fee)
+}
+
+// rebroadcastWithdrawal resends a pending withdrawal's signed transaction in
+// case it was never broadcast or was dropped from the mempool
+func rebroadcastWithdrawal(ctx context.Context, db *DB, rpc *RPCClient, w *Withdrawal) error {
+	raw, err := hex.DecodeString(w.rawTx)
+	if err != nil {
+		return fmt.Errorf("invalid raw transaction: %v", err)
+	}
+	signedTx := new(types.Transaction)
+	if err := signedTx.UnmarshalBinary(raw); err != nil {
+		return fmt.Errorf("failed to decode transaction: %v", err)
+	}
+
+	err = rpc.SendSignedTransaction(ctx, signedTx)
+	if err != nil && !strings.Contains(err.Error(), "already known") {
+		return db.setWithdrawalError(w.ID, err.Error())
+	}
+	if w.Status == WithdrawalSigned {
+		return db.setWithdrawalBroadcast(w.ID)
+	}
+	return nil
+}
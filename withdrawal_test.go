@@ -0,0 +1,206 @@
+package ethcashier
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// testRecipient is where test withdrawals are paid to
+const testRecipient = "0x00000000000000000000000000000000000000bb"
+
+// newTestWithdrawal credits the user 10 USD and has them withdraw 4 USD of
+// ETH
+func newTestWithdrawal(t *testing.T, db *DB) *Withdrawal {
+	t.Helper()
+	newTestUser(t, db, "alice")
+	if _, err := db.Post(LedgerDeposit, "", depositPostings(AccountTreasury, "alice", 10*MicrosPerDollar)...); err != nil {
+		t.Fatal(err)
+	}
+	w, err := db.CreateWithdrawal("alice", "ethereum", assetETH, testRecipient, 4*MicrosPerDollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// signTestTx signs a transfer of 1 wei to the given address at nonce with a
+// throwaway key
+func signTestTx(t *testing.T, to string, nonce uint64) *types.Transaction {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := common.HexToAddress(to)
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(1),
+		Nonce:     nonce,
+		To:        &recipient,
+		Value:     big.NewInt(1),
+		Gas:       21000,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(2),
+	})
+	signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(big.NewInt(1)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signedTx
+}
+
+func TestCreateWithdrawal(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  USD
+		wantErr error
+	}{
+		{name: "part of the balance", amount: 4 * MicrosPerDollar},
+		{name: "whole balance", amount: 10 * MicrosPerDollar},
+		{name: "more than the balance", amount: 10*MicrosPerDollar + 1, wantErr: ErrInsufficientFunds},
+		{name: "zero", amount: 0, wantErr: ErrNonPositiveAmount},
+		{name: "negative", amount: -1, wantErr: ErrNonPositiveAmount},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		newTestUser(t, db, "alice")
+		if _, err := db.Post(LedgerDeposit, "", depositPostings(AccountTreasury, "alice", 10*MicrosPerDollar)...); err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := db.CreateWithdrawal("alice", "ethereum", assetETH, testRecipient, tt.amount)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: CreateWithdrawal error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		want := USD(10 * MicrosPerDollar)
+		if err == nil {
+			want -= tt.amount
+			if w.Status != WithdrawalRequested {
+				t.Errorf("%s: status = %s, want %s", tt.name, w.Status, WithdrawalRequested)
+			}
+		}
+		user, err := db.GetUser("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Balance != want {
+			t.Errorf("%s: balance = %s, want %s", tt.name, user.Balance, want)
+		}
+	}
+}
+
+func TestWithdrawalTransitions(t *testing.T) {
+	errNotSigned := errors.New("withdrawal is no longer requested")
+	sign := func(db *DB, w *Withdrawal) error {
+		signed, err := db.setWithdrawalSigned(w.ID, 2000*MicrosPerDollar, big.NewInt(2e15), 2000*MicrosPerDollar, signTestTx(t, testRecipient, 0), testRecipient)
+		if err == nil && !signed {
+			err = errNotSigned
+		}
+		return err
+	}
+	broadcast := func(db *DB, w *Withdrawal) error { return db.setWithdrawalBroadcast(w.ID) }
+	confirm := func(db *DB, w *Withdrawal) error { return db.confirmWithdrawal(w, w.TxHash, big.NewInt(1e15)) }
+	fail := func(db *DB, w *Withdrawal) error { return db.failWithdrawal(w, "test", nil) }
+	refund := func(db *DB, w *Withdrawal) error { return db.refundWithdrawal(w) }
+
+	type step func(*DB, *Withdrawal) error
+	tests := []struct {
+		name        string
+		steps       []step
+		wantStatus  string
+		wantBalance USD
+		wantFees    USD
+		wantErr     error
+	}{
+		{name: "requested", wantStatus: WithdrawalRequested, wantBalance: 6 * MicrosPerDollar},
+		{name: "signed", steps: []step{sign}, wantStatus: WithdrawalSigned, wantBalance: 6 * MicrosPerDollar},
+		{
+			name:        "confirmed books the fee",
+			steps:       []step{sign, broadcast, confirm},
+			wantStatus:  WithdrawalConfirmed,
+			wantBalance: 6 * MicrosPerDollar,
+			wantFees:    2 * MicrosPerDollar,
+		},
+		{
+			name:        "failed is not refunded yet",
+			steps:       []step{sign, broadcast, fail},
+			wantStatus:  WithdrawalFailed,
+			wantBalance: 6 * MicrosPerDollar,
+		},
+		{
+			name:        "refunded",
+			steps:       []step{sign, fail, refund},
+			wantStatus:  WithdrawalRefunded,
+			wantBalance: 10 * MicrosPerDollar,
+		},
+		{
+			name:        "refunded exactly once",
+			steps:       []step{fail, refund, refund, fail, refund},
+			wantStatus:  WithdrawalRefunded,
+			wantBalance: 10 * MicrosPerDollar,
+		},
+		{
+			name:        "confirmed cannot fail",
+			steps:       []step{sign, confirm, fail, refund},
+			wantStatus:  WithdrawalConfirmed,
+			wantBalance: 6 * MicrosPerDollar,
+			wantFees:    2 * MicrosPerDollar,
+		},
+		{
+			name:        "requested cannot be refunded",
+			steps:       []step{refund},
+			wantStatus:  WithdrawalRequested,
+			wantBalance: 6 * MicrosPerDollar,
+		},
+		{
+			name:        "expired request cannot be signed",
+			steps:       []step{fail, sign},
+			wantStatus:  WithdrawalFailed,
+			wantBalance: 6 * MicrosPerDollar,
+			wantErr:     errNotSigned,
+		},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		w := newTestWithdrawal(t, db)
+
+		var err error
+		for _, step := range tt.steps {
+			if err = step(db, w); err != nil {
+				break
+			}
+			if w, err = db.GetWithdrawal(w.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+
+		w, err = db.GetWithdrawal(w.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Status != tt.wantStatus {
+			t.Errorf("%s: status = %s, want %s", tt.name, w.Status, tt.wantStatus)
+		}
+		user, err := db.GetUser("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Balance != tt.wantBalance {
+			t.Errorf("%s: balance = %s, want %s", tt.name, user.Balance, tt.wantBalance)
+		}
+		if fees, _ := db.AccountBalance(AccountFees); fees != tt.wantFees {
+			t.Errorf("%s: fees = %s, want %s", tt.name, fees, tt.wantFees)
+		}
+		if err := db.VerifyLedger(); err != nil {
+			t.Errorf("%s: VerifyLedger: %v", tt.name, err)
+		}
+	}
+}